@@ -30,4 +30,4 @@ require (
 	modernc.org/sqlite v1.23.1 // indirect
 )
 
-replace github.com/dansimau/hal => ../hal
+replace github.com/dansimau/hal => ./third_party/hal
@@ -1,13 +1,34 @@
 package main
 
 import (
-	"log/slog"
-	"os"
+	"time"
 
 	"github.com/dansimau/hal"
 	halautomations "github.com/dansimau/hal/automations"
 )
 
+// sensorSettleTime is how long a presence or motion sensor must stay clear
+// before automations act on it.
+const sensorSettleTime = time.Second
+
+// presenceLights returns lights that turn on as soon as their sensors trigger,
+// but only turn off once the sensors have settled and stopped flapping.
+func presenceLights(name string) *halautomations.SensorsTriggerLights {
+	return halautomations.NewSensorsTriggerLights().
+		WithName(name).
+		WithDebounce(sensorSettleTime, "off").
+		WithFlapDetection()
+}
+
+// presenceAutomation is like presenceLights, for automations that handle
+// presence changes themselves.
+func presenceAutomation(name string) *hal.AutomationConfig {
+	return hal.NewAutomation().
+		WithName(name).
+		WithDebounce(sensorSettleTime, "off").
+		WithFlapDetection()
+}
+
 type Marnixkade struct {
 	*hal.Connection
 
@@ -34,15 +55,9 @@ type Marnixkade struct {
 	NightModeUpstairs *hal.InputBoolean
 }
 
-func NewMarnixkade() *Marnixkade {
-	cfg, err := hal.LoadConfig()
-	if err != nil {
-		slog.Error("Error loading config", "error", err)
-		os.Exit(1)
-	}
-
+func NewMarnixkade(cfg hal.Config) *Marnixkade {
 	home := &Marnixkade{
-		Connection: hal.NewConnection(*cfg),
+		Connection: hal.NewConnection(cfg),
 
 		Bathroom:    newBathroom(),
 		Bedroom:     newBedroom(),
@@ -77,5 +92,8 @@ func NewMarnixkade() *Marnixkade {
 
 	home.RegisterAutomations(halautomations.NewPrintDebug("Debug", hal.NewEntity("event.main_switch_button_1")))
 
+	// Watch for sensors with flat batteries or that have stopped reporting
+	home.RegisterAutomations(halautomations.NewHealthMonitor("Sensor health").WithEntitiesFrom(home))
+
 	return home
 }
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/dansimau/hal/haltest"
+	"github.com/dansimau/hal/hassws"
+	"github.com/dansimau/hal/homeassistant"
+	"github.com/dansimau/hal/store"
+)
+
+// startHome boots the house against the fake Home Assistant and waits for the
+// initial sync. Call it again with the same harness to simulate a restart.
+func startHome(h *haltest.Harness) *Marnixkade {
+	home := NewMarnixkade(h.Config())
+	h.Start(home.Connection)
+
+	return home
+}
+
+func TestSensorHealthReportsLowBattery(t *testing.T) {
+	h := haltest.New(t)
+	h.Seed(
+		homeassistant.State{EntityID: "binary_sensor.bathroom_sensor_motion", State: "off"},
+		homeassistant.State{EntityID: "sensor.bathroom_sensor_battery", State: "12"},
+	)
+
+	home := startHome(h)
+
+	var health store.EntityHealth
+	if err := home.DB().First(&health, "entity_id = ?", "binary_sensor.bathroom_sensor_motion").Error; err != nil {
+		t.Fatalf("no health recorded: %v", err)
+	}
+
+	if health.Status != store.HealthStatusLowBattery {
+		t.Errorf("expected status %q, got %q", store.HealthStatusLowBattery, health.Status)
+	}
+
+	if !slices.ContainsFunc(h.ServiceCalls(), func(call hassws.ServiceCall) bool {
+		return call.Domain == "persistent_notification" && call.Service == "create"
+	}) {
+		t.Errorf("expected a notification, got calls: %+v", h.ServiceCalls())
+	}
+}
+
+func TestSensorHealthReportsSilentSensorsUnlessBatteryReports(t *testing.T) {
+	h := haltest.New(t)
+	h.Seed(
+		homeassistant.State{EntityID: "binary_sensor.bathroom_sensor_motion", State: "off"},
+		homeassistant.State{EntityID: "sensor.bathroom_sensor_battery", State: "90"},
+		homeassistant.State{EntityID: "binary_sensor.kitchen_motion", State: "off"},
+	)
+
+	home := startHome(h)
+
+	// Neither motion sensor reports, but the bathroom one's battery does
+	for _, level := range []string{"89", "88", "87", "86"} {
+		h.Advance(12 * time.Hour)
+		h.SetState("sensor.bathroom_sensor_battery", level)
+	}
+
+	for entityID, expected := range map[string]store.HealthStatus{
+		"binary_sensor.bathroom_sensor_motion": store.HealthStatusOK,
+		"binary_sensor.kitchen_motion":         store.HealthStatusStale,
+	} {
+		var health store.EntityHealth
+		if err := home.DB().First(&health, "entity_id = ?", entityID).Error; err != nil {
+			t.Fatalf("no health recorded for %s: %v", entityID, err)
+		}
+
+		if health.Status != expected {
+			t.Errorf("expected %s to be %q, got %q: %s", entityID, expected, health.Status, health.Detail)
+		}
+	}
+}
@@ -1,12 +1,21 @@
 package main
 
 import (
+	"context"
 	"log/slog"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/dansimau/hal"
 	"github.com/lmittmann/tint"
 )
 
+// shutdownTimeout is how long to wait for in-flight automations to finish on
+// shutdown. Docker sends SIGKILL 10 seconds after SIGTERM.
+const shutdownTimeout = 5 * time.Second
+
 func main() {
 	slog.SetDefault(slog.New(
 		tint.NewHandler(os.Stderr, &tint.Options{
@@ -14,10 +23,32 @@ func main() {
 		}),
 	))
 
-	if err := NewMarnixkade().Start(); err != nil {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	cfg, err := hal.LoadConfig()
+	if err != nil {
+		slog.Error("Error loading config", "error", err)
+		os.Exit(1)
+	}
+
+	home := NewMarnixkade(*cfg)
+
+	if err := home.Start(); err != nil {
 		slog.Error("Error starting home", "error", err)
 		os.Exit(1)
 	}
 
-	select {}
+	<-ctx.Done()
+	stop()
+
+	slog.Info("Received signal, shutting down")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := home.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Error shutting down", "error", err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dansimau/hal/haltest"
+	"github.com/dansimau/hal/homeassistant"
+)
+
+func seedBathroom(h *haltest.Harness) {
+	h.Seed(
+		homeassistant.State{EntityID: "binary_sensor.bathroom_sensor_motion", State: "off"},
+		homeassistant.State{EntityID: "event.bathroom_switch_button_4", State: "2024-06-01T08:00:00Z"},
+		homeassistant.State{EntityID: "input_boolean.bedtime_switch", State: "off"},
+		homeassistant.State{EntityID: "light.bathroom", State: "off"},
+		homeassistant.State{EntityID: "light.bathroom_fan", State: "on"},
+	)
+}
+
+func TestBathroomLightTurnsOffAfterMotionClears(t *testing.T) {
+	h := haltest.New(t)
+	seedBathroom(h)
+	startHome(h)
+
+	h.SetState("binary_sensor.bathroom_sensor_motion", "on")
+	h.AssertCalled("light.turn_on", "light.bathroom")
+	h.AssertState("light.bathroom", "on")
+
+	h.SetState("binary_sensor.bathroom_sensor_motion", "off")
+	h.ResetServiceCalls()
+
+	h.Advance(14 * time.Minute)
+	h.AssertNotCalled("light.turn_off", "light.bathroom")
+
+	h.Advance(2 * time.Minute)
+	h.AssertCalled("light.turn_off", "light.bathroom")
+	h.AssertState("light.bathroom", "off")
+}
+
+func TestBathroomTurnOffTimerRestoredAfterRestart(t *testing.T) {
+	h := haltest.New(t)
+	seedBathroom(h)
+	home := startHome(h)
+
+	h.SetState("binary_sensor.bathroom_sensor_motion", "on")
+	h.SetState("binary_sensor.bathroom_sensor_motion", "off")
+	h.Advance(5 * time.Minute)
+	home.Connection.Close()
+
+	startHome(h)
+	h.ResetServiceCalls()
+
+	h.Advance(9 * time.Minute)
+	h.AssertNotCalled("light.turn_off", "light.bathroom")
+
+	h.Advance(2 * time.Minute)
+	h.AssertCalled("light.turn_off", "light.bathroom")
+}
+
+func TestBathroomLightSwitchedOnWhileDownGetsFullTime(t *testing.T) {
+	h := haltest.New(t)
+	seedBathroom(h)
+	home := startHome(h)
+	home.Connection.Close()
+
+	// Someone switches the light on by hand long after motion last cleared
+	h.Clock.Add(time.Hour)
+	h.Seed(homeassistant.State{EntityID: "light.bathroom", State: "on"})
+	h.ResetServiceCalls()
+
+	startHome(h)
+	h.AssertNotCalled("light.turn_off", "light.bathroom")
+
+	h.Advance(14 * time.Minute)
+	h.AssertNotCalled("light.turn_off", "light.bathroom")
+
+	h.Advance(2 * time.Minute)
+	h.AssertCalled("light.turn_off", "light.bathroom")
+}
+
+func TestBathroomFanSwitchesOffOnDoublePress(t *testing.T) {
+	h := haltest.New(t)
+	seedBathroom(h)
+	startHome(h)
+
+	h.FireEvent("event.bathroom_switch_button_4", "initial_press")
+	h.AssertNotCalled("light.turn_off", "light.bathroom_fan")
+
+	h.FireEvent("event.bathroom_switch_button_4", "initial_press")
+	h.AssertCalled("light.turn_off", "light.bathroom_fan")
+
+	// Presses too far apart don't count as a double press
+	h.ResetServiceCalls()
+	h.Advance(5 * time.Second)
+	h.FireEvent("event.bathroom_switch_button_4", "initial_press")
+	h.Advance(5 * time.Second)
+	h.FireEvent("event.bathroom_switch_button_4", "initial_press")
+	h.AssertNotCalled("light.turn_off", "light.bathroom_fan")
+}
+
+func TestBathroomFanNotTurnedBackOnAfterReconnect(t *testing.T) {
+	h := haltest.New(t)
+	seedBathroom(h)
+	startHome(h)
+
+	h.SetState("light.bathroom", "on")
+	h.Advance(2 * time.Minute)
+	h.AssertCalled("light.turn_on", "light.bathroom_fan")
+
+	h.FireEvent("event.bathroom_switch_button_4", "initial_press")
+	h.FireEvent("event.bathroom_switch_button_4", "initial_press")
+	h.AssertState("light.bathroom_fan", "off")
+
+	h.ResetServiceCalls()
+	h.Reconnect()
+	h.AssertNotCalled("light.turn_on", "light.bathroom_fan")
+}
+
+func TestBathroomFanTimersCatchUpAfterLongOutage(t *testing.T) {
+	h := haltest.New(t)
+	seedBathroom(h)
+	h.Seed(homeassistant.State{EntityID: "light.bathroom", State: "on"})
+	home := startHome(h)
+	home.Connection.Close()
+
+	// The light goes off while hal is down, and stays off for longer than
+	// the fan off timer
+	h.Seed(homeassistant.State{EntityID: "light.bathroom", State: "off"})
+	h.Clock.Add(2 * time.Hour)
+	h.ResetServiceCalls()
+
+	home = startHome(h)
+	h.AssertCalled("light.turn_off", "light.bathroom_fan")
+	home.Connection.Close()
+
+	// Likewise for the light going on, with the fan off
+	h.Seed(homeassistant.State{EntityID: "light.bathroom", State: "on"})
+	h.Clock.Add(2 * time.Hour)
+	h.ResetServiceCalls()
+
+	startHome(h)
+	h.AssertCalled("light.turn_on", "light.bathroom_fan")
+}
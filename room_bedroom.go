@@ -4,7 +4,6 @@ import (
 	"time"
 
 	"github.com/dansimau/hal"
-	halautomations "github.com/dansimau/hal/automations"
 )
 
 type Bedroom struct {
@@ -49,8 +48,7 @@ func newBedroom() Bedroom {
 
 func (b *Bedroom) Automations(home *Marnixkade) []hal.Automation {
 	return []hal.Automation{
-		halautomations.NewSensorsTriggerLights().
-			WithName("Bedroom lights").
+		presenceLights("Bedroom lights").
 			WithCondition(func() bool {
 				return !home.NightMode.IsOn() // Don't auto turn on lights if night mode is on
 			}).
@@ -63,33 +61,37 @@ func (b *Bedroom) Automations(home *Marnixkade) []hal.Automation {
 			TurnsOffLights(home.Bedroom.AllLights).
 			TurnsOffAfter(5 * time.Minute),
 
-		halautomations.NewSensorsTriggerLights().
-			WithName("Bedroom closet lights").
+		presenceLights("Bedroom closet lights").
 			WithConditionScene(func() bool { return home.NightMode.IsOn() }, nightLight).
 			WithConditionScene(func() bool { return !home.NightMode.IsOn() }, brightLight).
 			WithSensors(home.Bedroom.ClosetMotionSensor).
 			WithLights(home.Bedroom.ClosetLights).
 			TurnsOffAfter(30 * time.Second),
 
-		halautomations.NewTimer("Detect person in bed").
+		hal.NewAutomation().
+			WithName("Detect person in bed").
 			WithEntities(home.Bedroom.PresenceSensor).
-			Condition(home.Bedroom.PresenceSensor.IsOn).
-			Duration(15 * time.Minute).
-			Run(func() {
-				if home.Bedroom.PresenceSensor.IsOn() {
-					home.NightMode.TurnOn()
-				}
+			WithToState("on").
+			For(15 * time.Minute).
+			HoldWhenUnavailable().
+			WithAction(func(_ hal.EntityInterface) {
+				home.NightMode.TurnOn()
 			}),
 
-		halautomations.NewTimer("Detect everyone out of bed").
+		hal.NewAutomation().
+			WithName("Detect everyone out of bed").
 			WithEntities(home.Bedroom.PresenceSensor).
-			Condition(home.Bedroom.PresenceSensor.IsOff).
-			Condition(func() bool { return time.Now().Hour() >= 10 && time.Now().Hour() < 20 }). // Only turn off during the day
-			Duration(20 * time.Minute).
-			Run(func() {
-				if home.Bedroom.PresenceSensor.IsOff() {
-					home.NightMode.TurnOff()
-				}
+			WithToState("off").
+			WithCondition(func() bool {
+				// Only turn off during the day
+				hour := home.Clock().Now().Hour()
+
+				return hour >= 10 && hour < 20
+			}).
+			For(20 * time.Minute).
+			HoldWhenUnavailable().
+			WithAction(func(_ hal.EntityInterface) {
+				home.NightMode.TurnOff()
 			}),
 	}
 }
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dansimau/hal/haltest"
+	"github.com/dansimau/hal/homeassistant"
+)
+
+const bedroomPresence = "binary_sensor.presence_sensor_fp2_1a4f_presence_sensor_1"
+
+func TestBedroomNightModeOnceSomeoneIsInBed(t *testing.T) {
+	h := haltest.New(t)
+	h.Seed(
+		homeassistant.State{EntityID: bedroomPresence, State: "off"},
+		homeassistant.State{EntityID: "input_boolean.bedtime_switch", State: "off"},
+	)
+	startHome(h)
+
+	// Getting up again cancels the hold
+	h.SetState(bedroomPresence, "on")
+	h.Advance(10 * time.Minute)
+	h.SetState(bedroomPresence, "off")
+	h.Advance(10 * time.Minute)
+	h.AssertState("input_boolean.bedtime_switch", "off")
+
+	h.SetState(bedroomPresence, "on")
+	h.Advance(14 * time.Minute)
+	h.AssertState("input_boolean.bedtime_switch", "off")
+
+	h.Advance(2 * time.Minute)
+	h.AssertState("input_boolean.bedtime_switch", "on")
+}
+
+func TestBedroomNightModeOffOnlyIfOutOfBedDuringTheDay(t *testing.T) {
+	h := haltest.New(t)
+	h.Seed(
+		homeassistant.State{EntityID: bedroomPresence, State: "on"},
+		homeassistant.State{EntityID: "input_boolean.bedtime_switch", State: "on"},
+	)
+	startHome(h)
+
+	// Out of bed at 08:00 the next morning: too early
+	h.Advance(20 * time.Hour)
+	h.SetState(bedroomPresence, "off")
+	h.Advance(time.Hour)
+	h.AssertState("input_boolean.bedtime_switch", "on")
+
+	// Out of bed at 19:50: counts, even though the hold ends after 20:00
+	h.SetState(bedroomPresence, "on")
+	h.Advance(10*time.Hour + 50*time.Minute)
+	h.SetState(bedroomPresence, "off")
+	h.Advance(21 * time.Minute)
+	h.AssertState("input_boolean.bedtime_switch", "off")
+}
@@ -4,7 +4,6 @@ import (
 	"time"
 
 	"github.com/dansimau/hal"
-	halautomations "github.com/dansimau/hal/automations"
 )
 
 type DiningRoom struct {
@@ -21,8 +20,7 @@ func newDiningRoom() DiningRoom {
 
 func (d *DiningRoom) Automations(home *Marnixkade) []hal.Automation {
 	return []hal.Automation{
-		halautomations.NewSensorsTriggerLights().
-			WithName("Dining table lights").
+		presenceLights("Dining table lights").
 			WithSensors(home.DiningRoom.PresenceSensor).
 			WithLights(home.DiningRoom.Lights).
 			SetScene(brightLight).
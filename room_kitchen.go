@@ -4,7 +4,6 @@ import (
 	"time"
 
 	"github.com/dansimau/hal"
-	halautomations "github.com/dansimau/hal/automations"
 )
 
 type Kitchen struct {
@@ -23,9 +22,9 @@ func newKitchen() Kitchen {
 
 func (k *Kitchen) Automations(home *Marnixkade) []hal.Automation {
 	return []hal.Automation{
-		halautomations.NewSensorsTriggerLights().
-			WithName("Kitchen strip light").
+		presenceLights("Kitchen strip light").
 			WithSensors(k.MotionSensor).
+			WithBackupSensors(k.PresenceSensor).
 			WithLights(k.StripLight).
 			TurnsOffAfter(15 * time.Minute),
 	}
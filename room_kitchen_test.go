@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dansimau/hal/haltest"
+	"github.com/dansimau/hal/homeassistant"
+)
+
+const (
+	kitchenMotion   = "binary_sensor.kitchen_motion"
+	kitchenPresence = "binary_sensor.presence_sensor_fp2_b6d8_presence_sensor_4"
+)
+
+func TestKitchenPresenceSensorIgnoredWhileMotionSensorWorks(t *testing.T) {
+	h := haltest.New(t)
+	h.Seed(
+		homeassistant.State{EntityID: kitchenMotion, State: "off"},
+		homeassistant.State{EntityID: kitchenPresence, State: "off"},
+		homeassistant.State{EntityID: "light.kitchen_strip", State: "off"},
+	)
+	startHome(h)
+
+	h.SetState(kitchenPresence, "on")
+	h.AssertNotCalled("light.turn_on", "light.kitchen_strip")
+
+	h.SetState(kitchenMotion, "on")
+	h.AssertCalled("light.turn_on", "light.kitchen_strip")
+}
+
+func TestKitchenFallsBackToPresenceSensor(t *testing.T) {
+	h := haltest.New(t)
+	h.Seed(
+		homeassistant.State{EntityID: kitchenMotion, State: "unavailable"},
+		homeassistant.State{EntityID: kitchenPresence, State: "off"},
+		homeassistant.State{EntityID: "light.kitchen_strip", State: "off"},
+	)
+	startHome(h)
+
+	h.SetState(kitchenPresence, "on")
+	h.AssertState("light.kitchen_strip", "on")
+
+	h.SetState(kitchenPresence, "off")
+	h.Advance(sensorSettleTime)
+	h.ResetServiceCalls()
+
+	h.Advance(16 * time.Minute)
+	h.AssertCalled("light.turn_off", "light.kitchen_strip")
+}
@@ -39,11 +39,16 @@ func newLivingRoom() LivingRoom {
 	}
 }
 
+// Lights turn off this long after presence is no longer detected.
+const livingRoomLightsOffAfter = 15 * time.Minute
+
 func (l *LivingRoom) Automations(home *Marnixkade) []hal.Automation {
+	l.LightsOffTimer.WithName("Living room lights off").WithAction(l.turnOffLights)
+
 	return []hal.Automation{
-		hal.NewAutomation().
-			WithName("Living room lights").
+		presenceAutomation("Living room lights").
 			WithEntities(home.LivingRoom.PresenceSensor).
+			WithTimers(&home.LivingRoom.LightsOffTimer).
 			WithAction(func(_ hal.EntityInterface) {
 				// Ignore presence changes if someone is actively watching TV or playing music
 				if home.LivingRoom.Onkyo.IsOn() {
@@ -51,23 +56,70 @@ func (l *LivingRoom) Automations(home *Marnixkade) []hal.Automation {
 				}
 
 				if home.LivingRoom.PresenceSensor.IsOn() {
-					home.LivingRoom.LightsOffTimer.Cancel()
+					l.turnOnLights(home)
+				} else {
+					home.LivingRoom.LightsOffTimer.Start(nil, livingRoomLightsOffAfter)
+				}
+			}).
+			WithReconcile(func() {
+				if home.LivingRoom.Onkyo.IsOn() {
+					return
+				}
 
-					// Only turn on the main lights if it's dark
-					if home.Upstairs.LuxSensor.Level() < 50 {
-						home.LivingRoom.MainLights.TurnOn()
+				if home.LivingRoom.PresenceSensor.IsOn() {
+					// Presence was detected while we were down
+					if !l.lightsOn() {
+						l.turnOnLights(home)
+					} else {
+						l.LightsOffTimer.Cancel()
 					}
 
-					// Always turn on the archer/pratt lamps
-					home.LivingRoom.ArcherLamp.TurnOn()
-					home.LivingRoom.PrattLamp.TurnOn()
-				} else {
-					home.LivingRoom.LightsOffTimer.Start(func() {
-						home.LivingRoom.MainLights.TurnOff()
-						home.LivingRoom.ArcherLamp.TurnOff()
-						home.LivingRoom.PrattLamp.TurnOff()
-					}, 15*time.Minute)
+					return
+				}
+
+				if !l.lightsOn() {
+					l.LightsOffTimer.Cancel()
+
+					return
 				}
+
+				// Timer was restored from before a restart
+				if l.LightsOffTimer.IsRunning() {
+					return
+				}
+
+				// The lights may have been switched on by hand since presence
+				// cleared, so give them the full time
+				l.LightsOffTimer.Start(nil, livingRoomLightsOffAfter)
 			}),
 	}
 }
+
+// lightsOn returns true if any of the lights controlled by the automation are
+// on.
+func (l *LivingRoom) lightsOn() bool {
+	return append(hal.LightGroup{l.ArcherLamp, l.PrattLamp}, l.MainLights...).AnyOn()
+}
+
+func (l *LivingRoom) turnOnLights(home *Marnixkade) {
+	l.LightsOffTimer.Cancel()
+
+	// Only turn on the main lights if it's dark
+	if home.Upstairs.LuxSensor.Level() < 50 {
+		l.MainLights.TurnOn()
+	}
+
+	// Always turn on the archer/pratt lamps
+	hal.LightGroup{
+		l.ArcherLamp,
+		l.PrattLamp,
+	}.TurnOn()
+}
+
+func (l *LivingRoom) turnOffLights() {
+	hal.LightGroup{
+		l.MainLights,
+		l.ArcherLamp,
+		l.PrattLamp,
+	}.TurnOff()
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dansimau/hal/haltest"
+	"github.com/dansimau/hal/homeassistant"
+)
+
+const livingRoomPresence = "binary_sensor.presence_sensor_fp2_b6d8_presence_sensor_3"
+
+func seedLivingRoom(h *haltest.Harness) {
+	h.Seed(
+		homeassistant.State{EntityID: livingRoomPresence, State: "on"},
+		homeassistant.State{EntityID: "light.archer_lamp", State: "on"},
+		homeassistant.State{EntityID: "light.pratt", State: "on"},
+		homeassistant.State{EntityID: "media_player.tx_8270", State: "off"},
+		homeassistant.State{EntityID: "sensor.presence_sensor_fp2_b6d8_light_sensor_light_level", State: "100"},
+	)
+}
+
+func TestLivingRoomLightsOffTimerRestoredAfterRestart(t *testing.T) {
+	h := haltest.New(t)
+	seedLivingRoom(h)
+	home := startHome(h)
+
+	h.SetState(livingRoomPresence, "off")
+	h.Advance(sensorSettleTime)
+	h.Advance(5 * time.Minute)
+	home.Connection.Close()
+
+	home = startHome(h)
+	h.ResetServiceCalls()
+
+	if !home.LivingRoom.LightsOffTimer.IsRunning() {
+		t.Fatal("expected the lights off timer to be restored")
+	}
+
+	h.Advance(9 * time.Minute)
+	h.AssertNotCalled("light.turn_off", "light.archer_lamp")
+
+	h.Advance(2 * time.Minute)
+	h.AssertCalled("light.turn_off", "light.archer_lamp")
+	h.AssertCalled("light.turn_off", "light.pratt")
+}
+
+func TestLivingRoomOverdueTimerFiresAfterRestart(t *testing.T) {
+	h := haltest.New(t)
+	seedLivingRoom(h)
+	home := startHome(h)
+
+	h.SetState(livingRoomPresence, "off")
+	h.Advance(sensorSettleTime)
+	h.Advance(time.Minute)
+	home.Connection.Close()
+
+	// hal is down while the timer is due
+	h.Clock.Add(30 * time.Minute)
+	h.ResetServiceCalls()
+
+	startHome(h)
+	h.AssertCalled("light.turn_off", "light.archer_lamp")
+}
+
+func TestLivingRoomOverdueTimerCancelledWhenPresenceReturned(t *testing.T) {
+	h := haltest.New(t)
+	seedLivingRoom(h)
+	home := startHome(h)
+
+	h.SetState(livingRoomPresence, "off")
+	h.Advance(sensorSettleTime)
+	h.Advance(time.Minute)
+	home.Connection.Close()
+
+	// Someone came back while hal was down, after the timer was due
+	h.Clock.Add(30 * time.Minute)
+	h.Seed(homeassistant.State{EntityID: livingRoomPresence, State: "on"})
+	h.ResetServiceCalls()
+
+	home = startHome(h)
+	h.AssertNotCalled("light.turn_off", "light.archer_lamp")
+
+	if home.LivingRoom.LightsOffTimer.IsRunning() {
+		t.Error("expected the lights off timer to be cancelled")
+	}
+}
+
+func TestLivingRoomLightsGetFullTimeAfterReconnect(t *testing.T) {
+	h := haltest.New(t)
+	seedLivingRoom(h)
+	startHome(h)
+
+	h.SetState(livingRoomPresence, "off")
+	h.Advance(sensorSettleTime)
+
+	// The lights go off, and are switched back on by hand a while later
+	h.Advance(16 * time.Minute)
+	h.AssertCalled("light.turn_off", "light.archer_lamp")
+	h.Advance(5 * time.Minute)
+	h.SetStateAsUser("someone", "light.archer_lamp", "on")
+
+	h.ResetServiceCalls()
+	h.Reconnect()
+	h.AssertNotCalled("light.turn_off", "light.archer_lamp")
+
+	h.Advance(16 * time.Minute)
+	h.AssertCalled("light.turn_off", "light.archer_lamp")
+}
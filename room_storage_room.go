@@ -4,7 +4,6 @@ import (
 	"time"
 
 	"github.com/dansimau/hal"
-	halautomations "github.com/dansimau/hal/automations"
 )
 
 type StorageRoom struct {
@@ -21,8 +20,7 @@ func newStorageRoom() StorageRoom {
 
 func (room *StorageRoom) Automations(home *Marnixkade) []hal.Automation {
 	return []hal.Automation{
-		halautomations.NewSensorsTriggerLights().
-			WithName("Storage room lights").
+		presenceLights("Storage room lights").
 			WithSensors(room.MotionSensor).
 			WithLights(room.Lights).
 			TurnsOffAfter(5 * time.Minute),
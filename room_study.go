@@ -32,8 +32,7 @@ func newStudy() Study {
 
 func (s *Study) Automations(home *Marnixkade) []hal.Automation {
 	return []hal.Automation{
-		halautomations.NewSensorsTriggerLights().
-			WithName("Study lights").
+		presenceLights("Study lights").
 			WithCondition(func() bool {
 				return !home.NightMode.IsOn() // Don't auto turn on lights if night mode is on
 			}).
@@ -0,0 +1,270 @@
+package hal
+
+import (
+	"slices"
+	"time"
+)
+
+type Automation interface {
+	// Name is a friendly name for the automation, used in logs and stats.
+	Name() string
+
+	// Entities should return a list of entities that this automation should
+	// listen on. For every state change to one of these entities, the
+	// automation will be trigged.
+	Entities() Entities
+
+	// Action is called when the automation is triggered.
+	Action(trigger EntityInterface)
+}
+
+// Reconciler is an interface that can be implemented by automations that need
+// to catch up on state changes they missed. Reconcile is called once after the
+// initial state sync and again after every reconnect, and should bring
+// devices and timers into the state they would be in had hal never stopped.
+type Reconciler interface {
+	Reconcile()
+}
+
+type AutomationConfig struct {
+	action        func(trigger EntityInterface)
+	entities      Entities
+	name          string
+	reconcile     func()
+	timers        []*Timer
+	triggerAction func(trigger Trigger)
+
+	// Rate limits, see Debouncer, Throttler and FlapDetector.
+	debounce       time.Duration
+	debounceStates []string
+	detectFlapping bool
+	throttle       time.Duration
+
+	// Trigger filters, see HandleTrigger.
+	attributes          []string
+	fromStates          []string
+	holdWhenUnavailable bool
+	ignoreAttributeOnly bool
+	toStates            []string
+
+	// Optional: must return true for the action to run, or a "for" hold to
+	// start.
+	condition func() bool
+
+	// "For" holds, keyed by entity ID. They are only accessed from the
+	// automation's queue.
+	holdFor       time.Duration
+	holdEntities  map[string]EntityInterface
+	holdTimers    map[string]*Timer
+	holdTimerList []*Timer
+	pendingHolds  map[string]Trigger
+}
+
+func NewAutomation() *AutomationConfig {
+	return &AutomationConfig{}
+}
+
+func (c *AutomationConfig) Entities() Entities {
+	return c.entities
+}
+
+// Action runs the action for the entity, without applying trigger filters.
+func (c *AutomationConfig) Action(trigger EntityInterface) {
+	c.run(Trigger{
+		Entity:   trigger,
+		NewState: trigger.GetState(),
+		Change:   LastChange(trigger),
+	})
+}
+
+func (c *AutomationConfig) run(trigger Trigger) {
+	if c.triggerAction != nil {
+		c.triggerAction(trigger)
+
+		return
+	}
+
+	if c.action != nil {
+		c.action(trigger.Entity)
+	}
+}
+
+// Timers returns the timers owned by the automation, including the timers of
+// "for" holds.
+func (c *AutomationConfig) Timers() []*Timer {
+	return slices.Concat(c.holdTimersFor(), c.timers)
+}
+
+func (c *AutomationConfig) Reconcile() {
+	c.reconcileHolds()
+
+	if c.reconcile != nil {
+		c.reconcile()
+	}
+}
+
+// Debounce returns the settle time set with WithDebounce.
+func (c *AutomationConfig) Debounce() time.Duration {
+	return c.debounce
+}
+
+// DebouncedStates returns the states set with WithDebounce.
+func (c *AutomationConfig) DebouncedStates() []string {
+	return c.debounceStates
+}
+
+// DetectFlapping returns true if flap detection was enabled with
+// WithFlapDetection.
+func (c *AutomationConfig) DetectFlapping() bool {
+	return c.detectFlapping
+}
+
+// Throttle returns the interval set with WithThrottle.
+func (c *AutomationConfig) Throttle() time.Duration {
+	return c.throttle
+}
+
+func (c *AutomationConfig) Name() string {
+	return c.name
+}
+
+func (c *AutomationConfig) WithAction(action func(trigger EntityInterface)) *AutomationConfig {
+	c.action = action
+
+	if c.name == "" {
+		c.name = getShortFunctionName(action)
+	}
+
+	return c
+}
+
+// WithTriggerAction sets an action that is passed the states before and after
+// the change that triggered the automation. It replaces any action set with
+// WithAction.
+func (c *AutomationConfig) WithTriggerAction(action func(trigger Trigger)) *AutomationConfig {
+	c.triggerAction = action
+
+	if c.name == "" {
+		c.name = getShortFunctionName(action)
+	}
+
+	return c
+}
+
+// WithCondition sets a condition that must be true when a state change
+// triggers the automation. With For, it is checked when the hold starts, not
+// when it ends.
+func (c *AutomationConfig) WithCondition(condition func() bool) *AutomationConfig {
+	c.condition = condition
+
+	return c
+}
+
+// WithFromState only triggers the automation when the entity changes from one
+// of the states.
+func (c *AutomationConfig) WithFromState(states ...string) *AutomationConfig {
+	c.fromStates = states
+
+	return c
+}
+
+// WithToState only triggers the automation when the entity changes to one of
+// the states.
+func (c *AutomationConfig) WithToState(states ...string) *AutomationConfig {
+	c.toStates = states
+
+	return c
+}
+
+// WithAttributeChanged only triggers the automation when one of the
+// attributes changes, e.g. "brightness".
+func (c *AutomationConfig) WithAttributeChanged(attributes ...string) *AutomationConfig {
+	c.attributes = attributes
+
+	return c
+}
+
+// WithoutAttributeChanges ignores changes to attributes that don't change the
+// state itself.
+func (c *AutomationConfig) WithoutAttributeChanges() *AutomationConfig {
+	c.ignoreAttributeOnly = true
+
+	return c
+}
+
+// HoldWhenUnavailable ignores changes to unavailable or unknown states, so the
+// automation acts as if the entity kept its last known state. "For" holds keep
+// running while the entity is unavailable.
+func (c *AutomationConfig) HoldWhenUnavailable() *AutomationConfig {
+	c.holdWhenUnavailable = true
+
+	return c
+}
+
+// For only runs the action once the entity has stayed in the triggering state
+// for the duration. The hold is cancelled if the entity leaves the states set
+// with WithToState before then. If none are set, the hold starts over whenever
+// the state changes. Holds of named automations are persisted and restored
+// after a restart.
+func (c *AutomationConfig) For(duration time.Duration) *AutomationConfig {
+	c.holdFor = duration
+
+	return c
+}
+
+// WithDebounce only triggers the automation once an entity hasn't changed for
+// the duration, with its latest state. If states are given, only changes to
+// those states are held back, e.g. "off" to act on a sensor triggering
+// straight away but wait for it to settle before acting on it clearing. See
+// Debouncer and StateDebouncer.
+func (c *AutomationConfig) WithDebounce(duration time.Duration, states ...string) *AutomationConfig {
+	c.debounce = duration
+	c.debounceStates = states
+
+	return c
+}
+
+// WithFlapDetection holds the automation back while an entity is flapping,
+// and triggers it with the latest change once the entity settles. See
+// FlapDetector.
+func (c *AutomationConfig) WithFlapDetection() *AutomationConfig {
+	c.detectFlapping = true
+
+	return c
+}
+
+// WithThrottle triggers the automation at most once per duration for each
+// entity. See Throttler.
+func (c *AutomationConfig) WithThrottle(duration time.Duration) *AutomationConfig {
+	c.throttle = duration
+
+	return c
+}
+
+func (c *AutomationConfig) WithEntities(entities ...EntityInterface) *AutomationConfig {
+	c.entities = entities
+
+	return c
+}
+
+func (c *AutomationConfig) WithName(name string) *AutomationConfig {
+	c.name = name
+
+	return c
+}
+
+// WithReconcile sets a function that is called after the initial state sync
+// and after every reconnect. See Reconciler.
+func (c *AutomationConfig) WithReconcile(reconcile func()) *AutomationConfig {
+	c.reconcile = reconcile
+
+	return c
+}
+
+// WithTimers attaches timers to the automation. Named timers are persisted
+// and restored after a restart.
+func (c *AutomationConfig) WithTimers(timers ...*Timer) *AutomationConfig {
+	c.timers = timers
+
+	return c
+}
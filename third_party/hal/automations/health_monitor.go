@@ -0,0 +1,368 @@
+package halautomations
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dansimau/hal"
+	"github.com/dansimau/hal/hassws"
+	"github.com/dansimau/hal/homeassistant"
+	"github.com/dansimau/hal/logger"
+	"github.com/dansimau/hal/store"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	defaultBatteryThreshold    = 20
+	defaultHealthCheckInterval = time.Hour
+	defaultStaleAfter          = 24 * time.Hour
+)
+
+// Domains of the entities that are monitored. These are the sensors and
+// buttons, which are often battery powered.
+var monitoredDomains = []string{"binary_sensor", "event", "sensor"}
+
+// HealthMonitor watches sensors and buttons for signs of failing hardware:
+// companion battery sensors (e.g. sensor.hallway_battery for
+// binary_sensor.hallway_motion) that are running low, sensors that Home
+// Assistant hasn't heard from for a while, and sensors that are unavailable.
+//
+// A sensor is stale once Home Assistant hasn't heard from it for a while.
+// A sensor in a quiet room can go days without changing, so if its battery
+// sensor has reported in that time, the sensor is taken to be alive.
+//
+// Sensors are checked on a timer, from the states the connection keeps,
+// rather than on every state change, so the monitor isn't triggered by every
+// motion event in the house.
+//
+// The health of every sensor is kept in the store, and a notification is
+// raised in Home Assistant when a sensor becomes unhealthy. The notification
+// is dismissed again when it recovers.
+type HealthMonitor struct {
+	name string
+
+	batteryThreshold float64
+	connection       *hal.Connection
+	entities         hal.Entities
+	interval         time.Duration
+	notifyService    string // optional: e.g. "notify.mobile_app_phone", in addition to a persistent notification
+	staleAfter       time.Duration
+
+	// Companion battery sensor for each entity, the last battery levels
+	// seen and when each battery sensor last reported. Only accessed from
+	// the automation's queue.
+	batteries       map[string]string
+	batteryLevels   map[string]float64
+	batteryReported map[string]time.Time
+
+	timer hal.Timer
+}
+
+func NewHealthMonitor(name string) *HealthMonitor {
+	return &HealthMonitor{
+		name:             name,
+		batteryThreshold: defaultBatteryThreshold,
+		interval:         defaultHealthCheckInterval,
+		staleAfter:       defaultStaleAfter,
+		batteries:        map[string]string{},
+		batteryLevels:    map[string]float64{},
+		batteryReported:  map[string]time.Time{},
+	}
+}
+
+// WithEntities sets the entities to monitor. Only sensors and buttons are
+// monitored.
+func (m *HealthMonitor) WithEntities(entities ...hal.EntityInterface) *HealthMonitor {
+	m.entities = nil
+
+	for _, entity := range entities {
+		domain, _, _ := strings.Cut(entity.GetID(), ".")
+		if slices.Contains(monitoredDomains, domain) {
+			m.entities = append(m.entities, entity)
+		}
+	}
+
+	return m
+}
+
+// WithEntitiesFrom monitors the sensors and buttons found in a struct, map or
+// slice, e.g. the whole house.
+func (m *HealthMonitor) WithEntitiesFrom(v any) *HealthMonitor {
+	return m.WithEntities(hal.EntitiesIn(v)...)
+}
+
+// WithBatteryThreshold sets the battery percentage at or below which a sensor
+// is reported (default: 20).
+func (m *HealthMonitor) WithBatteryThreshold(percent float64) *HealthMonitor {
+	m.batteryThreshold = percent
+
+	return m
+}
+
+// StaleAfter sets how long a sensor can go without an update from Home
+// Assistant before it is reported (default: 24h).
+func (m *HealthMonitor) StaleAfter(duration time.Duration) *HealthMonitor {
+	m.staleAfter = duration
+
+	return m
+}
+
+// CheckEvery sets how often every sensor is checked (default: 1h).
+func (m *HealthMonitor) CheckEvery(interval time.Duration) *HealthMonitor {
+	m.interval = interval
+
+	return m
+}
+
+// WithNotifyService also sends notifications to a notify service, e.g.
+// "notify.mobile_app_phone".
+func (m *HealthMonitor) WithNotifyService(service string) *HealthMonitor {
+	m.notifyService = service
+
+	return m
+}
+
+// BindConnection implements hal.ConnectionBinder.
+func (m *HealthMonitor) BindConnection(connection *hal.Connection) {
+	m.connection = connection
+}
+
+// Timers returns the timer of the periodic check, which is persisted under
+// the automation's name.
+func (m *HealthMonitor) Timers() []*hal.Timer {
+	return []*hal.Timer{m.timer.WithName(m.name).WithAction(m.check)}
+}
+
+func (m *HealthMonitor) Name() string {
+	return m.name
+}
+
+// Entities returns no entities, since the monitor isn't triggered by state
+// changes. The sensors are checked by its timer instead.
+func (m *HealthMonitor) Entities() hal.Entities {
+	return nil
+}
+
+// Action does nothing, since the monitor is never triggered by an entity.
+func (m *HealthMonitor) Action(_ hal.EntityInterface) {}
+
+// Reconcile checks every sensor on startup and after a reconnect.
+func (m *HealthMonitor) Reconcile() {
+	m.check()
+}
+
+// check looks up battery levels and checks every sensor, then schedules the
+// next check. Battery sensors are looked up in the states the connection
+// keeps, rather than fetched from Home Assistant.
+func (m *HealthMonitor) check() {
+	defer m.timer.Start(nil, m.interval)
+
+	m.discoverBatteries(m.connection.States())
+
+	for _, entity := range m.entities {
+		m.checkEntity(entity)
+	}
+}
+
+// discoverBatteries finds the companion battery sensor of each monitored
+// entity, and records the battery levels. A battery sensor belongs to an
+// entity if its name, without the "_battery" suffix, is a prefix of the
+// entity's name, e.g. sensor.hallway_battery for binary_sensor.hallway_motion.
+// The longest match wins.
+func (m *HealthMonitor) discoverBatteries(states []homeassistant.State) {
+	prefixes := map[string]string{}
+
+	for _, state := range states {
+		domain, object, _ := strings.Cut(state.EntityID, ".")
+		if domain != "sensor" || !strings.HasSuffix(object, "_battery") {
+			continue
+		}
+
+		prefixes[strings.TrimSuffix(object, "_battery")] = state.EntityID
+		m.batteryReported[state.EntityID] = lastReported(state)
+
+		level, err := strconv.ParseFloat(state.State, 64)
+		if err != nil {
+			delete(m.batteryLevels, state.EntityID)
+
+			continue
+		}
+
+		m.batteryLevels[state.EntityID] = level
+	}
+
+	for _, entity := range m.entities {
+		entityID := entity.GetID()
+		_, object, _ := strings.Cut(entityID, ".")
+
+		var match string
+
+		for prefix, batteryID := range prefixes {
+			if batteryID == entityID || len(prefix) <= len(match) {
+				continue
+			}
+
+			if object == prefix || strings.HasPrefix(object, prefix+"_") {
+				match = prefix
+			}
+		}
+
+		if match == "" {
+			delete(m.batteries, entityID)
+
+			continue
+		}
+
+		m.batteries[entityID] = prefixes[match]
+	}
+}
+
+// checkEntity works out the health of a sensor, records it and raises or
+// dismisses a notification if it changed.
+func (m *HealthMonitor) checkEntity(entity hal.EntityInterface) {
+	entityID := entity.GetID()
+	state := entity.GetState()
+	now := m.connection.Clock().Now()
+
+	// Entities that Home Assistant doesn't know about are reported when the
+	// connection starts, they aren't a sign of failing hardware.
+	if state.State == "" {
+		return
+	}
+
+	health := store.EntityHealth{
+		EntityID:        entityID,
+		Status:          store.HealthStatusOK,
+		BatteryEntityID: m.batteries[entityID],
+		LastUpdated:     lastReported(state),
+		StatusSince:     now,
+		CheckedAt:       now,
+	}
+
+	stale := !health.LastUpdated.IsZero() && now.Sub(health.LastUpdated) > m.staleAfter
+
+	// The battery sensor reports regularly, even if the sensor itself has
+	// nothing to report
+	if batteryReported, ok := m.batteryReported[health.BatteryEntityID]; ok && now.Sub(batteryReported) <= m.staleAfter {
+		stale = false
+	}
+
+	level, hasLevel := m.batteryLevels[health.BatteryEntityID]
+	if hasLevel {
+		health.BatteryLevel = &level
+	}
+
+	switch {
+	case !hal.IsAvailable(entity):
+		health.Status = store.HealthStatusUnavailable
+		health.Detail = fmt.Sprintf("%s is %s", friendlyName(state), state.State)
+	case stale:
+		health.Status = store.HealthStatusStale
+		health.Detail = fmt.Sprintf("%s hasn't reported since %s", friendlyName(state), health.LastUpdated.Format(time.DateTime))
+	case hasLevel && level <= m.batteryThreshold:
+		health.Status = store.HealthStatusLowBattery
+		health.Detail = fmt.Sprintf("%s battery is at %.0f%%", friendlyName(state), level)
+	}
+
+	db := m.connection.DB()
+
+	var previous store.EntityHealth
+
+	err := db.First(&previous, "entity_id = ?", entityID).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		logger.Error("Failed to load sensor health", entityID, "automation", m.name, "error", err)
+	}
+
+	changed := previous.Status != health.Status
+	if !changed {
+		health.StatusSince = previous.StatusSince
+	}
+
+	if err := db.Clauses(clause.OnConflict{
+		UpdateAll: true,
+	}).Create(&health).Error; err != nil {
+		logger.Error("Failed to record sensor health", entityID, "automation", m.name, "error", err)
+	}
+
+	if !changed {
+		return
+	}
+
+	if health.Status == store.HealthStatusOK {
+		// Nothing to report on the first check of a healthy sensor
+		if previous.Status != "" {
+			logger.Info("Sensor healthy again", entityID, "automation", m.name)
+			m.dismiss(entityID)
+		}
+
+		return
+	}
+
+	logger.Warn("Sensor unhealthy", entityID, "automation", m.name, "status", health.Status, "detail", health.Detail)
+	m.notify(entityID, health.Detail)
+}
+
+// notificationID is the ID of the persistent notification for an entity, so
+// that it can be replaced and dismissed.
+func notificationID(entityID string) string {
+	return "hal_health_" + strings.ReplaceAll(entityID, ".", "_")
+}
+
+func (m *HealthMonitor) notify(entityID, message string) {
+	m.callService("persistent_notification", "create", map[string]any{
+		"notification_id": notificationID(entityID),
+		"title":           m.name,
+		"message":         message,
+	})
+
+	if m.notifyService == "" {
+		return
+	}
+
+	domain, service, _ := strings.Cut(m.notifyService, ".")
+	m.callService(domain, service, map[string]any{
+		"title":   m.name,
+		"message": message,
+	})
+}
+
+func (m *HealthMonitor) dismiss(entityID string) {
+	m.callService("persistent_notification", "dismiss", map[string]any{
+		"notification_id": notificationID(entityID),
+	})
+}
+
+func (m *HealthMonitor) callService(domain, service string, data map[string]any) {
+	if _, err := m.connection.CallService(hassws.CallServiceRequest{
+		Type:    hassws.MessageTypeCallService,
+		Domain:  domain,
+		Service: service,
+		Data:    data,
+	}); err != nil {
+		logger.Error("Failed to send health notification", "", "automation", m.name, "service", domain+"."+service, "error", err)
+	}
+}
+
+// lastReported returns when Home Assistant last heard from an entity, even if
+// its state didn't change.
+func lastReported(state homeassistant.State) time.Time {
+	if state.LastReported.After(state.LastUpdated) {
+		return state.LastReported
+	}
+
+	return state.LastUpdated
+}
+
+// friendlyName returns the name Home Assistant shows for an entity, or its ID.
+func friendlyName(state homeassistant.State) string {
+	if name, ok := state.Attributes["friendly_name"].(string); ok && name != "" {
+		return name
+	}
+
+	return state.EntityID
+}
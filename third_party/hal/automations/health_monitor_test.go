@@ -0,0 +1,123 @@
+package halautomations
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/dansimau/hal"
+	"github.com/dansimau/hal/haltest"
+	"github.com/dansimau/hal/homeassistant"
+	"github.com/dansimau/hal/store"
+)
+
+const (
+	testMotion  = "binary_sensor.hallway_motion"
+	testBattery = "sensor.hallway_battery"
+)
+
+func startHealthMonitor(t *testing.T) (*haltest.Harness, *hal.Connection) {
+	t.Helper()
+
+	h := haltest.New(t)
+	h.Seed(
+		homeassistant.State{EntityID: testMotion, State: "off"},
+		homeassistant.State{EntityID: testBattery, State: "90"},
+	)
+
+	entities := struct {
+		Motion *hal.BinarySensor
+	}{
+		Motion: hal.NewBinarySensor(testMotion),
+	}
+
+	connection := h.StartConnection(&entities, NewHealthMonitor("Health").WithEntitiesFrom(&entities))
+
+	return h, connection
+}
+
+func healthOf(t *testing.T, connection *hal.Connection, entityID string) store.EntityHealth {
+	t.Helper()
+
+	var health store.EntityHealth
+	if err := connection.DB().First(&health, "entity_id = ?", entityID).Error; err != nil {
+		t.Fatalf("no health recorded for %s: %v", entityID, err)
+	}
+
+	return health
+}
+
+func TestHealthMonitorUsesLatestBatteryLevelWithoutFetchingStates(t *testing.T) {
+	h, connection := startHealthMonitor(t)
+
+	getStates := func() int {
+		n := 0
+
+		for _, message := range h.Server.MessagesReceived() {
+			if bytes.Contains(message, []byte(`"type":"get_states"`)) {
+				n++
+			}
+		}
+
+		return n
+	}
+
+	fetched := getStates()
+
+	h.SetState(testBattery, "10")
+	h.Advance(time.Hour)
+
+	if health := healthOf(t, connection, testMotion); health.Status != store.HealthStatusLowBattery {
+		t.Errorf("expected status %q, got %q", store.HealthStatusLowBattery, health.Status)
+	}
+
+	if n := getStates() - fetched; n != 0 {
+		t.Errorf("expected no states to be fetched by the periodic check, got %d requests", n)
+	}
+}
+
+func TestHealthMonitorReportsSensorSilentWhileBatteryIs(t *testing.T) {
+	h, connection := startHealthMonitor(t)
+
+	h.Advance(12 * time.Hour)
+	h.SetState(testBattery, "89")
+	h.Advance(13 * time.Hour)
+
+	if health := healthOf(t, connection, testMotion); health.Status != store.HealthStatusOK {
+		t.Errorf("expected a sensor whose battery reports to be healthy, got %q: %s", health.Status, health.Detail)
+	}
+
+	h.Advance(12 * time.Hour)
+
+	if health := healthOf(t, connection, testMotion); health.Status != store.HealthStatusStale {
+		t.Errorf("expected status %q once the battery stops reporting too, got %q", store.HealthStatusStale, health.Status)
+	}
+}
+
+func TestHealthMonitorChecksSensorsOnItsTimerOnly(t *testing.T) {
+	h, connection := startHealthMonitor(t)
+
+	h.SetState(testMotion, "on")
+	h.SetState(testMotion, hal.StateUnavailable)
+
+	var triggers int64
+	if err := connection.DB().Model(&store.Metric{}).
+		Where("metric_type = ? AND entity_id = ?", store.MetricTypeAutomationTriggered, testMotion).
+		Count(&triggers).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if triggers != 0 {
+		t.Errorf("expected the monitor not to be triggered by sensor changes, got %d triggers", triggers)
+	}
+
+	if health := healthOf(t, connection, testMotion); health.Status != store.HealthStatusOK {
+		t.Errorf("expected the sensor to be checked on the next check, got %q", health.Status)
+	}
+
+	h.Advance(time.Hour)
+
+	if health := healthOf(t, connection, testMotion); health.Status != store.HealthStatusUnavailable {
+		t.Errorf("expected status %q, got %q", store.HealthStatusUnavailable, health.Status)
+	}
+}
@@ -0,0 +1,638 @@
+package halautomations
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/dansimau/hal"
+	"github.com/dansimau/hal/logger"
+)
+
+type ConditionScene struct {
+	Condition func() bool
+	Scene     map[string]any
+}
+
+// SensorsTriggerLights is an automation that combines one or more sensors
+// (motion or presence sensors) and a set of lights. Lights are turned on when
+// any of the sensors are triggered and turned off after a given duration.
+type SensorsTriggerLights struct {
+	name string
+
+	// Brightness is the brightness of the lights when they are turned on. We
+	// have to set a brightness here so support dimming lights before turn off.
+	// The reason is that Home Assistant doesn't support changing the brightness of
+	// a light while it is off. Because the light is dimmed prior to turn off,
+	// turning it back on would mean it comes back on in a dimmed state. Thus we
+	// have to specify a default brightness when turning on to avoid this.
+	brightness float64
+	scene      map[string]any
+
+	backupSensors          []hal.EntityInterface // optional: sensors used while all of the sensors are unavailable
+	clock                  clock.Clock           // optional: set with WithClock, otherwise bound from the connection
+	condition              func() bool           // optional: func that must return true for the automation to run
+	conditionScene         []ConditionScene
+	debounce               time.Duration // optional: settle time for sensor and light changes
+	debounceStates         []string      // optional: only debounce changes to these states
+	detectFlapping         bool          // optional: hold back while a sensor or light is flapping
+	deviceOverride         bool          // optional: treat changes reported by the lights themselves as an override
+	dimLightsBeforeTurnOff time.Duration
+	humanOverrideFor       *time.Duration // optional: duration after which lights will turn off after being turned on from outside this system
+	sensors                []hal.EntityInterface
+	throttle               time.Duration // optional: minimum time between triggers from the same entity
+	turnsOnLights          []hal.LightInterface
+	turnsOffLights         []hal.LightInterface
+	turnsOffAfter          *time.Duration // optional: duration after which lights will turn off after being turned on
+
+	dimLightsTimer     hal.Timer
+	humanOverrideTimer hal.Timer
+	turnOffTimer       hal.Timer
+}
+
+func NewSensorsTriggerLights() *SensorsTriggerLights {
+	return &SensorsTriggerLights{
+		dimLightsBeforeTurnOff: time.Second * 10,
+		brightness:             255,
+	}
+}
+
+// WithBrightness sets the brightness of the lights when they are turned on.
+func (a *SensorsTriggerLights) WithBrightness(brightness float64) *SensorsTriggerLights {
+	a.brightness = brightness
+
+	return a
+}
+
+// WithClock can be used to pass in a mock clock for testing. It takes
+// precedence over the clock of the connection.
+func (a *SensorsTriggerLights) WithClock(c clock.Clock) *SensorsTriggerLights {
+	a.clock = c
+	a.dimLightsTimer.WithClock(c)
+	a.humanOverrideTimer.WithClock(c)
+	a.turnOffTimer.WithClock(c)
+
+	return a
+}
+
+// BindClock sets the clock used for timers, unless one was already set with
+// WithClock. It is called by the connection when the automation is registered.
+func (a *SensorsTriggerLights) BindClock(c clock.Clock) {
+	if a.clock != nil {
+		return
+	}
+
+	a.WithClock(c)
+}
+
+// Timers returns the automation's timers so they can be bound to the
+// connection. If the automation has a name, the timers are named after it so
+// that they are persisted and restored after a restart.
+func (a *SensorsTriggerLights) Timers() []*hal.Timer {
+	if a.name == "" {
+		return []*hal.Timer{&a.dimLightsTimer, &a.humanOverrideTimer, &a.turnOffTimer}
+	}
+
+	return []*hal.Timer{
+		a.dimLightsTimer.WithName(a.name + ": dim lights").WithAction(a.dimLights),
+		a.humanOverrideTimer.WithName(a.name + ": human override"),
+		a.turnOffTimer.WithName(a.name + ": turn off").WithAction(a.turnOffLights),
+	}
+}
+
+// WithCondition sets a condition that must be true for the automation to run.
+func (a *SensorsTriggerLights) WithCondition(condition func() bool) *SensorsTriggerLights {
+	a.condition = condition
+
+	return a
+}
+
+// WithConditionScene allows you to specify a scene to trigger based on a condition.
+func (a *SensorsTriggerLights) WithConditionScene(condition func() bool, scene map[string]any) *SensorsTriggerLights {
+	a.conditionScene = append(a.conditionScene, ConditionScene{
+		Condition: condition,
+		Scene:     scene,
+	})
+
+	return a
+}
+
+// WithBackupSensors sets sensors that are used in place of the sensors while
+// all of them are unavailable, e.g. a motion sensor backing up a presence
+// sensor. If the backup sensors are unavailable too, the lights and timers are
+// left as they are.
+func (a *SensorsTriggerLights) WithBackupSensors(sensors ...hal.EntityInterface) *SensorsTriggerLights {
+	a.backupSensors = sensors
+
+	return a
+}
+
+// WithDebounce waits for sensors and lights to stop changing for the duration
+// before acting on the change, e.g. for presence sensors that flap on and off.
+// If states are given, only changes to those states are held back, so with
+// "off" the lights still come on as soon as a sensor triggers.
+func (a *SensorsTriggerLights) WithDebounce(duration time.Duration, states ...string) *SensorsTriggerLights {
+	a.debounce = duration
+	a.debounceStates = states
+
+	return a
+}
+
+// WithFlapDetection ignores sensors and lights while they are flapping, and
+// acts on their latest change once they settle.
+func (a *SensorsTriggerLights) WithFlapDetection() *SensorsTriggerLights {
+	a.detectFlapping = true
+
+	return a
+}
+
+// WithThrottle acts on changes of each sensor and light at most once per
+// duration. The latest change is acted on at the end of the interval.
+func (a *SensorsTriggerLights) WithThrottle(duration time.Duration) *SensorsTriggerLights {
+	a.throttle = duration
+
+	return a
+}
+
+// DimLightsBeforeTurnOff sets the duration before lights will turn off after
+// being turned on.
+func (a *SensorsTriggerLights) DimLightsBeforeTurnOff(duration time.Duration) *SensorsTriggerLights {
+	a.dimLightsBeforeTurnOff = duration
+
+	return a
+}
+
+// WithDeviceOverride treats changes reported by the lights themselves, e.g.
+// from a wall switch or a remote paired with the lights, as a human override
+// too. Reports that merely echo a change made by hal are still ignored.
+func (a *SensorsTriggerLights) WithDeviceOverride() *SensorsTriggerLights {
+	a.deviceOverride = true
+
+	return a
+}
+
+// WithHumanOverrideFor sets a secondary timer that will kick in if the light
+// was turned on from outside this system.
+func (a *SensorsTriggerLights) WithHumanOverrideFor(duration time.Duration) *SensorsTriggerLights {
+	a.humanOverrideFor = &duration
+
+	return a
+}
+
+// WithLights sets the lights that will be turned on and off. Overrides
+// TurnsOnLights and TurnsOffLights.
+func (a *SensorsTriggerLights) WithLights(lights ...hal.LightInterface) *SensorsTriggerLights {
+	a.turnsOnLights = lights
+	a.turnsOffLights = lights
+
+	return a
+}
+
+// WithName sets the name of the automation (appears in logs).
+func (a *SensorsTriggerLights) WithName(name string) *SensorsTriggerLights {
+	a.name = name
+
+	return a
+}
+
+// WithSensors sets the sensors that will trigger the lights.
+func (a *SensorsTriggerLights) WithSensors(sensors ...hal.EntityInterface) *SensorsTriggerLights {
+	a.sensors = sensors
+
+	return a
+}
+
+// TurnsOnLights sets the lights that will be turned on by the sensor. This can
+// be used in conjunction with TurnsOffLights to turn on and off different sets
+// of lights.
+func (a *SensorsTriggerLights) TurnsOnLights(lights ...hal.LightInterface) *SensorsTriggerLights {
+	a.turnsOnLights = lights
+
+	return a
+}
+
+// TurnsOffLights sets the lights that will be turned off by the sensor. This can
+// be used in conjunction with TurnsOnLights to turn on and off different sets
+// of lights.
+func (a *SensorsTriggerLights) TurnsOffLights(lights ...hal.LightInterface) *SensorsTriggerLights {
+	a.turnsOffLights = lights
+
+	return a
+}
+
+// TurnsOffAfter sets the duration after which the lights will turn off after being
+// turned on.
+func (a *SensorsTriggerLights) TurnsOffAfter(turnsOffAfter time.Duration) *SensorsTriggerLights {
+	a.turnsOffAfter = &turnsOffAfter
+
+	return a
+}
+
+func (a *SensorsTriggerLights) SetScene(scene map[string]any) *SensorsTriggerLights {
+	a.scene = scene
+
+	return a
+}
+
+// activeSensors returns the sensors that are available. If none of the
+// sensors are available, the available backup sensors are used instead.
+func (a *SensorsTriggerLights) activeSensors() []hal.EntityInterface {
+	for _, sensors := range [][]hal.EntityInterface{a.sensors, a.backupSensors} {
+		available := []hal.EntityInterface{}
+
+		for _, sensor := range sensors {
+			if hal.IsAvailable(sensor) {
+				available = append(available, sensor)
+			}
+		}
+
+		if len(available) > 0 {
+			return available
+		}
+	}
+
+	return nil
+}
+
+// triggered returns true if any of the available sensors have been
+// triggered.
+func (a *SensorsTriggerLights) triggered() bool {
+	for _, sensor := range a.activeSensors() {
+		if sensor.GetState().State == "on" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// lightsOn returns true if any of the lights turned on by this automation are
+// on.
+func (a *SensorsTriggerLights) lightsOn() bool {
+	for _, light := range hal.ExpandLights(a.turnsOnLights...) {
+		if light.IsOn() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// anyTurnsOffLightOn returns true if any of the lights turned off by this
+// automation are on.
+func (a *SensorsTriggerLights) anyTurnsOffLightOn() bool {
+	for _, light := range hal.ExpandLights(a.turnsOffLights...) {
+		if light.IsOn() {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (a *SensorsTriggerLights) startDimLightsTimer() {
+	if a.turnsOffAfter == nil {
+		return
+	}
+
+	if a.dimLightsBeforeTurnOff < 0 {
+		return
+	}
+
+	dimLightsAfter := *a.turnsOffAfter - a.dimLightsBeforeTurnOff
+	if dimLightsAfter < 1*time.Second {
+		return
+	}
+
+	logger.Info("Starting dim lights timer", "", "automation", a.name, "duration", dimLightsAfter.String())
+	a.dimLightsTimer.Start(a.dimLights, dimLightsAfter)
+}
+
+func (a *SensorsTriggerLights) startTurnOffTimer() {
+	if a.turnsOffAfter == nil {
+		return
+	}
+
+	logger.Info("Starting turn off timer", "", "automation", a.name, "duration", a.turnsOffAfter.String())
+	a.turnOffTimer.Start(a.turnOffLights, *a.turnsOffAfter)
+
+	a.startDimLightsTimer()
+}
+
+func (a *SensorsTriggerLights) stopTurnOffTimer() {
+	wasRunning := a.turnOffTimer.IsRunning()
+
+	logger.Info("Cancelling turn off timer", "", "automation", a.name, "wasRunning", wasRunning)
+
+	a.turnOffTimer.Cancel()
+}
+
+func (a *SensorsTriggerLights) stopDimLightsTimer() {
+	wasRunning := a.dimLightsTimer.IsRunning()
+
+	logger.Info("Cancelling dim lights timer", "", "automation", a.name, "wasRunning", wasRunning)
+
+	a.dimLightsTimer.Cancel()
+}
+
+func (a *SensorsTriggerLights) turnOnLights() {
+	var attributes map[string]any
+
+	// If a scene is set, use it.
+	if a.scene != nil {
+		attributes = a.scene
+	}
+
+	// If a condition scene matches use that
+	for _, conditionScene := range a.conditionScene {
+		if conditionScene.Condition() {
+			attributes = conditionScene.Scene
+		}
+	}
+
+	// Otherwise use the default brightness.
+	if attributes == nil {
+		attributes = map[string]any{"brightness": a.brightness}
+	}
+
+	logger.Info("Turning on lights", "", "automation", a.name, "attributes", attributes)
+
+	requests := make([]hal.LightTurnOn, len(a.turnsOnLights))
+	for i, light := range a.turnsOnLights {
+		requests[i] = hal.LightTurnOn{Light: light, Attributes: attributes}
+	}
+
+	if err := hal.TurnOnLights(context.Background(), requests...); err != nil {
+		logger.Error("Error turning on lights", "", "automation", a.name, "error", err)
+	}
+}
+
+func (a *SensorsTriggerLights) dimLights() {
+	logger.Info("Dimming lights prior to turning off", "", "automation", a.name)
+
+	// Lights at the same brightness are dimmed together in a single call
+	requests := []hal.LightTurnOn{}
+
+	for _, light := range hal.ExpandLights(a.turnsOffLights...) {
+		brightness := light.GetBrightness()
+		if brightness < 2 {
+			logger.Info("Light is already at minimum brightness, skipping dimming", "", "automation", a.name, "light", light.GetID())
+
+			continue
+		}
+
+		requests = append(requests, hal.LightTurnOn{
+			Light:      light,
+			Attributes: map[string]any{"brightness": brightness / 2},
+		})
+	}
+
+	if err := hal.TurnOnLights(context.Background(), requests...); err != nil {
+		logger.Error("Error dimming lights", "", "automation", a.name, "error", err)
+	}
+}
+
+func (a *SensorsTriggerLights) turnOffLights() {
+	logger.Info("Turning off lights", "", "automation", a.name)
+
+	if err := hal.TurnOffLights(context.Background(), a.turnsOffLights...); err != nil {
+		logger.Error("Error turning off lights", "", "automation", a.name, "error", err)
+	}
+}
+
+func (a *SensorsTriggerLights) isTurnOnLight(entity hal.EntityInterface) bool {
+	for _, light := range a.turnsOnLights {
+		if slices.Contains(hal.EntityIDs(light), entity.GetID()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (a *SensorsTriggerLights) isSensor(entity hal.EntityInterface) bool {
+	for _, sensor := range slices.Concat(a.sensors, a.backupSensors) {
+		if sensor.GetID() == entity.GetID() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isIdleBackupSensor returns true for a backup sensor while the sensors it
+// backs up are available.
+func (a *SensorsTriggerLights) isIdleBackupSensor(entity hal.EntityInterface) bool {
+	isBackup := slices.ContainsFunc(a.backupSensors, func(sensor hal.EntityInterface) bool {
+		return sensor.GetID() == entity.GetID()
+	})
+
+	return isBackup && !slices.ContainsFunc(a.activeSensors(), func(sensor hal.EntityInterface) bool {
+		return sensor.GetID() == entity.GetID()
+	})
+}
+
+func (a *SensorsTriggerLights) handleSensorStateChange() {
+	logger.Info("Sensor state change", "", "automation", a.name)
+
+	if a.humanOverrideTimer.IsRunning() {
+		logger.Info("Light overridden by human, skipping", "", "automation", a.name)
+
+		return
+	}
+
+	if a.condition != nil && !a.condition() {
+		logger.Info("Condition not met, skipping", "", "automation", a.name)
+
+		return
+	}
+
+	// An unavailable sensor says nothing about whether the room is
+	// occupied, so leave the lights and timers as they are.
+	if len(a.activeSensors()) == 0 {
+		logger.Warn("Sensors unavailable, holding current state", "", "automation", a.name)
+
+		return
+	}
+
+	if a.triggered() {
+		lightsWereDimmedFromTimer := a.isLightDimmedFromTimer()
+
+		logger.Info("Sensor triggered", "", "automation", a.name, "lightsWereDimmedFromTimer", lightsWereDimmedFromTimer)
+
+		a.stopTurnOffTimer()
+		a.stopDimLightsTimer()
+
+		// This avoids a situation where the user has changed the lights state
+		// but it gets overridden by a sensor being triggered again.
+		if a.lightsOn() && !lightsWereDimmedFromTimer {
+			logger.Info("Sensor triggered, but lights are already on, ignoring", "", "automation", a.name)
+
+			return
+		}
+
+		logger.Info("Sensor triggered, turning on lights", "", "automation", a.name)
+		a.turnOnLights()
+	} else {
+		logger.Info("Sensor cleared, starting turn off countdown", "", "automation", a.name)
+		a.startTurnOffTimer()
+	}
+}
+
+func (a *SensorsTriggerLights) handleLightStateChanged(change hal.StateChange) {
+	logger.Info("Light state change", "", "automation", a.name, "cause", change.Cause.String(), "user", change.UserID)
+
+	// Only a person using Home Assistant counts as an override, or a device
+	// change if opted in with WithDeviceOverride. Changes made by hal and by
+	// Home Assistant automations, and the bridge reporting them back, don't.
+	if !a.isOverride(change) {
+		logger.Debug("Light not changed by a human, ignoring", "", "automation", a.name)
+
+		return
+	}
+
+	// Light was either turned on or off, or brightness changed or whatever,
+	// in which case we want to stop any further automations since the user has
+	// overridden it and we want to respect that.
+	a.stopDimLightsTimer()
+	a.stopTurnOffTimer()
+
+	if a.humanOverrideFor != nil {
+		if a.lightsOn() {
+			logger.Info("Light turned on, setting human override", "", "automation", a.name, "duration", a.humanOverrideFor.String())
+			a.humanOverrideTimer.Start(nil, *a.humanOverrideFor)
+		} else {
+			logger.Info("Light turned off, cancelling human override", "", "automation", a.name)
+			a.humanOverrideTimer.Cancel()
+		}
+	}
+}
+
+// isOverride returns true if the light change should stop the automation.
+func (a *SensorsTriggerLights) isOverride(change hal.StateChange) bool {
+	if change.IsHuman() {
+		return true
+	}
+
+	return a.deviceOverride && change.Cause == hal.CauseDevice && !change.Echo
+}
+
+// isLightDimmedFromTimer returns true if the lights are dimmed from the timer.
+func (a *SensorsTriggerLights) isLightDimmedFromTimer() bool {
+	return a.dimLightsBeforeTurnOff > 0 && !a.dimLightsTimer.IsRunning() && a.turnOffTimer.IsRunning()
+}
+
+// HandleTrigger implements hal.TriggerHandler, so that light changes are
+// judged by what caused the change that triggered the automation, rather than
+// by whatever changed the light since.
+func (a *SensorsTriggerLights) HandleTrigger(trigger hal.Trigger) {
+	logger.Info("Automation triggered with event", "", "automation", a.name, "state", trigger.NewState)
+
+	if a.isIdleBackupSensor(trigger.Entity) {
+		logger.Debug("Backup sensor not in use, ignoring", "", "automation", a.name)
+
+		return
+	}
+
+	if a.isSensor(trigger.Entity) {
+		a.handleSensorStateChange()
+	} else if a.isTurnOnLight(trigger.Entity) {
+		a.handleLightStateChanged(trigger.Change)
+	}
+}
+
+func (a *SensorsTriggerLights) Action(triggerEntity hal.EntityInterface) {
+	a.HandleTrigger(hal.Trigger{
+		Entity:   triggerEntity,
+		NewState: triggerEntity.GetState(),
+		Change:   hal.LastChange(triggerEntity),
+	})
+}
+
+// Reconcile brings the lights and timers into the state they would be in had
+// the automation seen every sensor change. If the sensors are triggered it
+// behaves as if they just triggered. If they are clear but lights are still
+// on, the full turn off countdown is started, so lights left on while hal was
+// down are turned off. The countdown starts from now rather than from when the
+// sensors cleared, since the lights may have been switched on by hand since.
+func (a *SensorsTriggerLights) Reconcile() {
+	if a.humanOverrideTimer.IsRunning() {
+		logger.Info("Light overridden by human, skipping reconcile", "", "automation", a.name)
+
+		return
+	}
+
+	if a.condition != nil && !a.condition() {
+		logger.Info("Condition not met, skipping reconcile", "", "automation", a.name)
+
+		return
+	}
+
+	if len(a.activeSensors()) == 0 {
+		logger.Warn("Sensors unavailable, holding current state on reconcile", "", "automation", a.name)
+
+		return
+	}
+
+	if a.triggered() {
+		a.handleSensorStateChange()
+
+		return
+	}
+
+	if a.turnsOffAfter == nil {
+		return
+	}
+
+	if !a.anyTurnsOffLightOn() {
+		a.stopDimLightsTimer()
+		a.stopTurnOffTimer()
+
+		return
+	}
+
+	// Timer was restored from before a restart
+	if a.turnOffTimer.IsRunning() {
+		return
+	}
+
+	logger.Info("Sensors clear but lights on, starting turn off countdown", "", "automation", a.name)
+	a.startTurnOffTimer()
+}
+
+func (a *SensorsTriggerLights) Entities() hal.Entities {
+	entities := []hal.EntityInterface{}
+	entities = append(entities, a.sensors...)
+	entities = append(entities, a.backupSensors...)
+
+	for _, light := range a.turnsOnLights {
+		entities = append(entities, light)
+	}
+
+	return hal.Entities(entities)
+}
+
+func (a *SensorsTriggerLights) Name() string {
+	return a.name
+}
+
+// Debounce implements hal.Debouncer.
+func (a *SensorsTriggerLights) Debounce() time.Duration {
+	return a.debounce
+}
+
+// DebouncedStates implements hal.StateDebouncer.
+func (a *SensorsTriggerLights) DebouncedStates() []string {
+	return a.debounceStates
+}
+
+// DetectFlapping implements hal.FlapDetector.
+func (a *SensorsTriggerLights) DetectFlapping() bool {
+	return a.detectFlapping
+}
+
+// Throttle implements hal.Throttler.
+func (a *SensorsTriggerLights) Throttle() time.Duration {
+	return a.throttle
+}
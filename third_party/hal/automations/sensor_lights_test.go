@@ -0,0 +1,207 @@
+package halautomations
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/dansimau/hal"
+	"github.com/dansimau/hal/haltest"
+	"github.com/dansimau/hal/hassws"
+	"github.com/dansimau/hal/homeassistant"
+)
+
+const (
+	testSensor = "binary_sensor.test_motion"
+	testLight  = "light.test"
+)
+
+// startSensorsTriggerLights starts a connection with a sensor, a light and
+// the automation returned by configure, with the lights off and the sensor
+// clear.
+func startSensorsTriggerLights(t *testing.T, configure func(a *SensorsTriggerLights)) *haltest.Harness {
+	t.Helper()
+
+	h := haltest.New(t)
+	h.Seed(
+		homeassistant.State{EntityID: testSensor, State: "off"},
+		homeassistant.State{EntityID: testLight, State: "off"},
+	)
+
+	entities := struct {
+		Sensor *hal.BinarySensor
+		Light  *hal.Light
+	}{
+		Sensor: hal.NewBinarySensor(testSensor),
+		Light:  hal.NewLight(testLight),
+	}
+
+	automation := NewSensorsTriggerLights().
+		WithName("Test lights").
+		WithSensors(entities.Sensor).
+		WithLights(entities.Light).
+		TurnsOffAfter(10 * time.Minute)
+	configure(automation)
+
+	h.StartConnection(&entities, automation)
+
+	return h
+}
+
+func TestSensorsTriggerLightsOverrideOnlyByHumans(t *testing.T) {
+	tests := []struct {
+		name     string
+		change   func(h *haltest.Harness)
+		override bool
+	}{
+		{
+			name: "user",
+			change: func(h *haltest.Harness) {
+				h.SetStateAsUser("someone", testLight, "on", map[string]any{"brightness": 100})
+			},
+			override: true,
+		},
+		{
+			name:   "device",
+			change: func(h *haltest.Harness) { h.SetState(testLight, "on", map[string]any{"brightness": 100}) },
+		},
+		{
+			name: "automation",
+			change: func(h *haltest.Harness) {
+				h.Server.SetStateWithContext(testLight, "on", map[string]any{"brightness": 100}, homeassistant.EventMessageContext{
+					ID:       "automation-context",
+					ParentID: "automation-parent",
+				})
+				h.Settle()
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := startSensorsTriggerLights(t, func(a *SensorsTriggerLights) {
+				a.DimLightsBeforeTurnOff(-1)
+			})
+
+			h.SetState(testSensor, "on")
+			h.SetState(testSensor, "off")
+
+			// Past the window in which the light reporting back is an echo
+			h.Advance(time.Minute)
+			test.change(h)
+
+			h.ResetServiceCalls()
+			h.Advance(11 * time.Minute)
+
+			if called := h.Called("light.turn_off", testLight); called == test.override {
+				t.Errorf("expected override %v, but turn off called %v", test.override, called)
+			}
+		})
+	}
+}
+
+func TestSensorsTriggerLightsDeviceOverride(t *testing.T) {
+	h := startSensorsTriggerLights(t, func(a *SensorsTriggerLights) {
+		a.DimLightsBeforeTurnOff(-1).WithDeviceOverride()
+	})
+
+	h.SetState(testSensor, "on")
+	h.SetState(testSensor, "off")
+	h.Advance(time.Minute)
+	h.SetState(testLight, "on", map[string]any{"brightness": 100})
+
+	h.ResetServiceCalls()
+	h.Advance(11 * time.Minute)
+	h.AssertNotCalled("light.turn_off", testLight)
+}
+
+func TestSensorsTriggerLightsDimsLightsAtTheSameBrightnessTogether(t *testing.T) {
+	h := haltest.New(t)
+	h.Seed(homeassistant.State{EntityID: testSensor, State: "off"})
+
+	lightIDs := []string{"light.a", "light.b", "light.c"}
+
+	lights := make(hal.LightGroup, len(lightIDs))
+	for i, entityID := range lightIDs {
+		h.Seed(homeassistant.State{EntityID: entityID, State: "off"})
+		lights[i] = hal.NewLight(entityID)
+	}
+
+	entities := struct {
+		Sensor *hal.BinarySensor
+		Lights hal.LightGroup
+	}{
+		Sensor: hal.NewBinarySensor(testSensor),
+		Lights: lights,
+	}
+
+	h.StartConnection(&entities, NewSensorsTriggerLights().
+		WithName("Test lights").
+		WithSensors(entities.Sensor).
+		WithLights(entities.Lights).
+		TurnsOffAfter(10*time.Minute))
+
+	h.SetState(testSensor, "on")
+	h.SetState("light.c", "on", map[string]any{"brightness": 100})
+	h.SetState(testSensor, "off")
+
+	h.ResetServiceCalls()
+	h.Advance(10*time.Minute - 10*time.Second)
+
+	calls := h.ServiceCalls()
+	if len(calls) != 2 {
+		t.Fatalf("expected one dimming call per brightness, got %+v", calls)
+	}
+
+	if !slices.Equal(calls[0].EntityIDs, []string{"light.a", "light.b"}) || calls[0].Data["brightness"] != 127.5 {
+		t.Errorf("expected light.a and light.b to be dimmed to 127.5, got %+v", calls[0])
+	}
+
+	if !slices.Equal(calls[1].EntityIDs, []string{"light.c"}) || calls[1].Data["brightness"] != float64(50) {
+		t.Errorf("expected light.c to be dimmed to 50, got %+v", calls[1])
+	}
+}
+
+func TestSensorsTriggerLightsDimsGroupMembersIndividually(t *testing.T) {
+	h := haltest.New(t)
+	h.Seed(
+		homeassistant.State{EntityID: testSensor, State: "off"},
+		homeassistant.State{EntityID: "light.group", State: "on", Attributes: map[string]any{
+			"entity_id": []any{"light.a", "light.b"},
+		}},
+		homeassistant.State{EntityID: "light.a", State: "on", Attributes: map[string]any{"brightness": 200}},
+		homeassistant.State{EntityID: "light.b", State: "on", Attributes: map[string]any{"brightness": 100}},
+	)
+
+	entities := struct {
+		Sensor *hal.BinarySensor
+		Group  *hal.Light
+	}{
+		Sensor: hal.NewBinarySensor(testSensor),
+		Group:  hal.NewLight("light.group"),
+	}
+
+	h.StartConnection(&entities, NewSensorsTriggerLights().
+		WithName("Test lights").
+		WithSensors(entities.Sensor).
+		WithLights(entities.Group).
+		TurnsOffAfter(10*time.Minute))
+
+	h.SetState(testSensor, "on")
+	h.SetState(testSensor, "off")
+
+	h.ResetServiceCalls()
+	h.Advance(10*time.Minute - 10*time.Second)
+
+	// Each member keeps its brightness relative to the others
+	for entityID, brightness := range map[string]float64{"light.a": 100, "light.b": 50} {
+		i := slices.IndexFunc(h.ServiceCalls(), func(call hassws.ServiceCall) bool {
+			return slices.Equal(call.EntityIDs, []string{entityID})
+		})
+		if i < 0 || h.ServiceCalls()[i].Data["brightness"] != brightness {
+			t.Errorf("expected %s to be dimmed to %v, got %+v", entityID, brightness, h.ServiceCalls())
+		}
+	}
+
+	h.AssertNotCalled("light.turn_on", "light.group")
+}
@@ -0,0 +1,163 @@
+package halautomations
+
+import (
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/dansimau/hal"
+	"github.com/dansimau/hal/logger"
+)
+
+type Timer struct {
+	action     func()
+	clock      clock.Clock
+	conditions []func() bool
+	delay      time.Duration
+	entities   hal.Entities
+	name       string
+	timer      hal.Timer
+
+	// When the action last ran, so that reconciling doesn't run it again for
+	// the same change.
+	lastFired  time.Time
+	firedMutex sync.Mutex
+}
+
+func NewTimer(name string) *Timer {
+	return &Timer{
+		name: name,
+	}
+}
+
+// BindClock sets the clock used to tell whether the timer is overdue. It is
+// called by the connection when the automation is registered.
+func (a *Timer) BindClock(c clock.Clock) {
+	a.clock = c
+}
+
+// Timers returns the underlying timer, which is persisted under the
+// automation's name so a pending action survives a restart.
+func (a *Timer) Timers() []*hal.Timer {
+	return []*hal.Timer{a.timer.WithName(a.name).WithAction(a.runAction)}
+}
+
+// Condition sets a condition that must be true for the timer to start.
+func (a *Timer) Condition(condition func() bool) *Timer {
+	a.conditions = append(a.conditions, condition)
+
+	return a
+}
+
+// Duration sets the duration of the delay.
+func (a *Timer) Duration(duration time.Duration) *Timer {
+	a.delay = duration
+
+	return a
+}
+
+// WithEntities sets the entities that trigger or reset the timer.
+func (a *Timer) WithEntities(entities ...hal.EntityInterface) *Timer {
+	a.entities = entities
+
+	return a
+}
+
+// Run sets the action to be run after the delay.
+func (a *Timer) Run(action func()) *Timer {
+	a.action = action
+
+	return a
+}
+
+// startTimer starts the timer.
+func (a *Timer) startTimer() {
+	logger.Info("Starting timer", "", "automation", a.name)
+
+	a.timer.Start(a.runAction, a.delay)
+}
+
+// stopTimer stops the timer.
+func (a *Timer) stopTimer() {
+	a.timer.Cancel()
+}
+
+func (a *Timer) runAction() {
+	logger.Info("Timer elapsed, executing action", "", "automation", a.name)
+
+	a.firedMutex.Lock()
+	a.lastFired = a.now()
+	a.firedMutex.Unlock()
+
+	a.action()
+}
+
+func (a *Timer) Name() string {
+	return a.name
+}
+
+func (a *Timer) Entities() hal.Entities {
+	return a.entities
+}
+
+func (a *Timer) Action(_ hal.EntityInterface) {
+	for i, condition := range a.conditions {
+		if !condition() {
+			logger.Info("Timer condition not met, stopping existing timer", "", "automation", a.name, "condition", i)
+			a.stopTimer()
+			return
+		}
+	}
+
+	a.startTimer()
+}
+
+// Reconcile starts the timer if its conditions are met and it is not already
+// running, counting from when the entities last changed. If the delay has
+// already elapsed, e.g. the entities changed while hal was down, the action
+// runs straight away, unless it already ran since the change. If the
+// conditions are not met, the timer is stopped.
+func (a *Timer) Reconcile() {
+	for i, condition := range a.conditions {
+		if !condition() {
+			logger.Info("Timer condition not met on reconcile, stopping timer", "", "automation", a.name, "condition", i)
+			a.stopTimer()
+
+			return
+		}
+	}
+
+	if a.timer.IsRunning() {
+		return
+	}
+
+	lastChanged := a.entities.LastChanged()
+	if lastChanged.IsZero() {
+		a.startTimer()
+
+		return
+	}
+
+	a.firedMutex.Lock()
+	fired := !a.lastFired.Before(lastChanged)
+	a.firedMutex.Unlock()
+
+	deadline := lastChanged.Add(a.delay)
+	if !deadline.After(a.now()) && fired {
+		logger.Info("Timer already fired since last change, leaving it stopped", "", "automation", a.name, "since", lastChanged)
+
+		return
+	}
+
+	// Fires straight away if the deadline has passed
+	logger.Info("Starting timer on reconcile", "", "automation", a.name, "since", lastChanged)
+	a.timer.StartUntil(a.runAction, deadline)
+}
+
+func (a *Timer) now() time.Time {
+	if a.clock == nil {
+		return time.Now()
+	}
+
+	return a.clock.Now()
+}
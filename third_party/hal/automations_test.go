@@ -0,0 +1,92 @@
+package hal_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dansimau/hal"
+	"github.com/dansimau/hal/haltest"
+)
+
+// startFilteredConnection starts a connection with an automation on the test
+// sensor that records the states it is triggered with, configured by
+// configure.
+func startFilteredConnection(t *testing.T, configure func(a *hal.AutomationConfig)) (*haltest.Harness, *stateRecorder) {
+	t.Helper()
+
+	recorder := &stateRecorder{}
+
+	h, _ := startConnection(t, func(sensor *hal.BinarySensor) []hal.Automation {
+		automation := hal.NewAutomation().
+			WithName("Filtered").
+			WithEntities(sensor).
+			WithTriggerAction(recorder.record)
+		configure(automation)
+
+		return []hal.Automation{automation}
+	})
+
+	return h, recorder
+}
+
+func TestFromStateOnlyTriggersOnChangesFromThoseStates(t *testing.T) {
+	h, recorder := startFilteredConnection(t, func(a *hal.AutomationConfig) {
+		a.WithFromState("on")
+	})
+
+	for _, state := range []string{"on", "off", hal.StateUnavailable, "on", "off"} {
+		h.SetState(testSensor, state)
+	}
+
+	recorder.assert(t, "off", "off")
+}
+
+func TestAttributeChangedOnlyTriggersOnThoseAttributes(t *testing.T) {
+	h, recorder := startFilteredConnection(t, func(a *hal.AutomationConfig) {
+		a.WithAttributeChanged("battery")
+	})
+
+	h.SetState(testSensor, "off", map[string]any{"battery": 50})
+
+	// The state and other attributes changing don't trigger it
+	h.SetState(testSensor, "on", map[string]any{"battery": 50})
+	h.SetState(testSensor, "on", map[string]any{"battery": 50, "signal": 3})
+
+	h.SetState(testSensor, "on", map[string]any{"battery": 40, "signal": 3})
+
+	recorder.assert(t, "off", "on")
+}
+
+func TestWithoutAttributeChangesIgnoresAttributeOnlyChanges(t *testing.T) {
+	h, recorder := startFilteredConnection(t, func(a *hal.AutomationConfig) {
+		a.WithoutAttributeChanges()
+	})
+
+	h.SetState(testSensor, "off", map[string]any{"battery": 50})
+	h.SetState(testSensor, "on", map[string]any{"battery": 50})
+	h.SetState(testSensor, "on", map[string]any{"battery": 40})
+	h.SetState(testSensor, "off", map[string]any{"battery": 40})
+
+	recorder.assert(t, "on", "off")
+}
+
+func TestForHoldIsCancelledByInterveningChange(t *testing.T) {
+	h, recorder := startFilteredConnection(t, func(a *hal.AutomationConfig) {
+		a.WithToState("on").For(time.Minute)
+	})
+
+	h.SetState(testSensor, "on")
+	h.Advance(30 * time.Second)
+	h.SetState(testSensor, "off")
+	h.Advance(time.Minute)
+	recorder.assert(t)
+
+	// An attribute change doesn't break the hold
+	h.SetState(testSensor, "on")
+	h.Advance(30 * time.Second)
+	h.SetState(testSensor, "on", map[string]any{"battery": 40})
+	recorder.assert(t)
+
+	h.Advance(30 * time.Second)
+	recorder.assert(t, "on")
+}
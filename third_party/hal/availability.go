@@ -0,0 +1,163 @@
+package hal
+
+import (
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dansimau/hal/homeassistant"
+	"github.com/dansimau/hal/logger"
+)
+
+// States that Home Assistant reports when it has no value for an entity,
+// e.g. when a Zigbee device has dropped off the network.
+const (
+	StateUnavailable = "unavailable"
+	StateUnknown     = "unknown"
+)
+
+const defaultUnavailableThreshold = time.Hour
+
+// isAvailableState returns false for states that don't hold a value for the
+// entity.
+func isAvailableState(state string) bool {
+	return state != StateUnavailable && state != StateUnknown && state != ""
+}
+
+// IsAvailable returns false if the entity is unavailable, its state is
+// unknown, or its state hasn't been synced from Home Assistant yet.
+func (e *Entity) IsAvailable() bool {
+	return isAvailableState(e.GetState().State)
+}
+
+// UnavailableSince returns the time the entity became unavailable, or the zero
+// time if it is available.
+func (e *Entity) UnavailableSince() time.Time {
+	since := e.unavailableSince.Load()
+	if since == nil {
+		return time.Time{}
+	}
+
+	return *since
+}
+
+// updateAvailability tracks when the entity became unavailable. Changes
+// between unavailable and unknown don't reset it.
+func (e *Entity) updateAvailability(state homeassistant.State) {
+	if isAvailableState(state.State) {
+		e.unavailableSince.Store(nil)
+
+		return
+	}
+
+	if e.unavailableSince.Load() != nil {
+		return
+	}
+
+	since := state.LastChanged
+	if since.IsZero() {
+		since = e.getClock().Now()
+	}
+
+	e.unavailableSince.Store(&since)
+}
+
+// IsAvailable returns false if the entity is unavailable, or its state is
+// unknown. For light groups, the group is available if any member is.
+func IsAvailable(entity EntityInterface) bool {
+	if group, ok := entity.(LightGroup); ok {
+		return slices.ContainsFunc(group.Members(), func(member LightInterface) bool {
+			return IsAvailable(member)
+		})
+	}
+
+	if availability, ok := entity.(interface{ IsAvailable() bool }); ok {
+		return availability.IsAvailable()
+	}
+
+	return isAvailableState(entity.GetState().State)
+}
+
+// UnavailableEntity is an entity that has been unavailable for a while.
+type UnavailableEntity struct {
+	EntityID string
+
+	// Path is the struct field the entity was found at, if any.
+	Path string
+
+	State string
+	Since time.Time
+}
+
+// UnavailableEntities returns the registered entities that have been
+// unavailable or unknown for longer than the threshold, longest first. A zero
+// threshold returns every unavailable entity.
+func (h *Connection) UnavailableEntities(threshold time.Duration) []UnavailableEntity {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	now := h.clock.Now()
+	unavailable := []UnavailableEntity{}
+
+	for entityID, entity := range h.entities {
+		tracker, ok := entity.(interface{ UnavailableSince() time.Time })
+		if !ok {
+			continue
+		}
+
+		since := tracker.UnavailableSince()
+		if since.IsZero() || (threshold > 0 && now.Sub(since) < threshold) {
+			continue
+		}
+
+		unavailable = append(unavailable, UnavailableEntity{
+			EntityID: entityID,
+			Path:     h.entityPaths[entityID],
+			State:    entity.GetState().State,
+			Since:    since,
+		})
+	}
+
+	slices.SortFunc(unavailable, func(a, b UnavailableEntity) int {
+		if c := a.Since.Compare(b.Since); c != 0 {
+			return c
+		}
+
+		return strings.Compare(a.EntityID, b.EntityID)
+	})
+
+	return unavailable
+}
+
+func (h *Connection) unavailableThreshold() time.Duration {
+	if h.config.UnavailableThreshold <= 0 {
+		return defaultUnavailableThreshold
+	}
+
+	return h.config.UnavailableThreshold
+}
+
+// reportUnavailable logs the entities that have been unavailable for longer
+// than the configured threshold.
+func (h *Connection) reportUnavailable() {
+	for _, entity := range h.UnavailableEntities(h.unavailableThreshold()) {
+		logger.Warn("Entity has been unavailable for a long time", entity.EntityID, "state", entity.State, "since", entity.Since, "path", describeEntityPath(entity.Path))
+	}
+}
+
+// reportUnavailablePeriodically reports unavailable entities once every
+// threshold, so entities that drop off while the connection is up are
+// reported too.
+func (h *Connection) reportUnavailablePeriodically() {
+	ticker := h.clock.Ticker(h.unavailableThreshold())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.watchdogStopChan:
+			return
+		case <-ticker.C:
+			h.reportUnavailable()
+		}
+	}
+}
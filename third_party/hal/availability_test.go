@@ -0,0 +1,51 @@
+package hal_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dansimau/hal"
+)
+
+func TestUnavailableEntitiesAreReportedAfterThreshold(t *testing.T) {
+	var sensor *hal.BinarySensor
+
+	h, connection := startConnection(t, func(s *hal.BinarySensor) []hal.Automation {
+		sensor = s
+
+		return nil
+	})
+
+	h.SetState(testSensor, hal.StateUnavailable)
+	since := h.Clock.Now()
+
+	if hal.IsAvailable(sensor) {
+		t.Error("expected an unavailable sensor not to be available")
+	}
+
+	h.Advance(time.Minute)
+
+	// Going from unavailable to unknown doesn't start the clock over
+	h.SetState(testSensor, hal.StateUnknown)
+
+	if unavailable := connection.UnavailableEntities(time.Hour); len(unavailable) != 0 {
+		t.Errorf("expected no entities unavailable for an hour yet, got %v", unavailable)
+	}
+
+	h.Advance(time.Hour)
+
+	unavailable := connection.UnavailableEntities(time.Hour)
+	if len(unavailable) != 1 || unavailable[0].EntityID != testSensor || !unavailable[0].Since.Equal(since) {
+		t.Fatalf("expected %s to be unavailable since %s, got %v", testSensor, since, unavailable)
+	}
+
+	h.SetState(testSensor, "off")
+
+	if !hal.IsAvailable(sensor) {
+		t.Error("expected the sensor to be available again")
+	}
+
+	if unavailable := connection.UnavailableEntities(0); len(unavailable) != 0 {
+		t.Errorf("expected no unavailable entities, got %v", unavailable)
+	}
+}
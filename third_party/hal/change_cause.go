@@ -0,0 +1,167 @@
+package hal
+
+import (
+	"sync"
+	"time"
+
+	"github.com/dansimau/hal/homeassistant"
+)
+
+// Context IDs of service calls made by hal are remembered for this long, which
+// is plenty of time for the resulting state changes to arrive.
+const ownContextTTL = 5 * time.Minute
+
+// Changes reported by a device this soon after hal changed it are taken to be
+// the device reporting back hal's change, see StateChange.Echo.
+const halEchoWindow = 10 * time.Second
+
+// ChangeCause is what caused a state change, as worked out from the context
+// of the state_changed event.
+type ChangeCause int
+
+const (
+	// CauseDevice is a change reported by the device itself, e.g. a sensor
+	// detecting motion or a light switched at the wall.
+	CauseDevice ChangeCause = iota
+
+	// CauseHal is a change caused by a service call made by hal.
+	CauseHal
+
+	// CauseUser is a change made by a Home Assistant user, e.g. from the app
+	// or the dashboard.
+	CauseUser
+
+	// CauseAutomation is a change made by an automation or script in Home
+	// Assistant.
+	CauseAutomation
+)
+
+func (c ChangeCause) String() string {
+	switch c {
+	case CauseDevice:
+		return "device"
+	case CauseHal:
+		return "hal"
+	case CauseUser:
+		return "user"
+	case CauseAutomation:
+		return "automation"
+	}
+
+	return "unknown"
+}
+
+// StateChange describes what caused the last state change of an entity.
+type StateChange struct {
+	Cause ChangeCause
+
+	// UserID is the Home Assistant user that made the change, if any.
+	UserID string
+
+	// ContextID is the ID of the Home Assistant context of the change.
+	ContextID string
+
+	// Echo is true for a change reported by a device shortly after hal
+	// changed it, that leaves its state as it was, e.g. a Hue bridge catching
+	// up on the brightness hal set. Echoes have CauseDevice.
+	Echo bool
+
+	// Time is when the change was received.
+	Time time.Time
+}
+
+// IsHuman returns true if the change was made by a person through Home
+// Assistant.
+func (c StateChange) IsHuman() bool {
+	return c.Cause == CauseUser
+}
+
+// isEcho returns true if a change reported by a device repeats a change hal
+// made moments before. The state must be unchanged, so a light switched at the
+// wall right after hal turned it on is not an echo.
+func isEcho(previous, change StateChange, stateChanged bool) bool {
+	if change.Cause != CauseDevice || stateChanged {
+		return false
+	}
+
+	if previous.Cause != CauseHal && !previous.Echo {
+		return false
+	}
+
+	return change.Time.Sub(previous.Time) <= halEchoWindow
+}
+
+// stateChanged returns true if the event changes the state itself, as opposed
+// to only its attributes.
+func stateChanged(data homeassistant.EventData) bool {
+	if data.OldState == nil || data.NewState == nil {
+		return true
+	}
+
+	return data.OldState.State != data.NewState.State
+}
+
+// ownContexts remembers the context IDs returned by service calls made by hal,
+// so that the state changes they cause can be recognised.
+type ownContexts struct {
+	mutex sync.Mutex
+	ids   map[string]time.Time
+}
+
+func (c *ownContexts) add(id string, now time.Time) {
+	if id == "" {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.ids == nil {
+		c.ids = map[string]time.Time{}
+	}
+
+	for existing, added := range c.ids {
+		if now.Sub(added) > ownContextTTL {
+			delete(c.ids, existing)
+		}
+	}
+
+	c.ids[id] = now
+}
+
+func (c *ownContexts) contains(id string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	_, ok := c.ids[id]
+
+	return ok
+}
+
+// classifyChange works out what caused a state change from its context.
+// Changes from hal are recognised by the context ID of a service call made by
+// hal, or by hal's user ID, since the state change can arrive before the
+// result of the service call. Home Assistant sets a parent context on changes
+// made by automations, and a user ID on changes made by users.
+func (h *Connection) classifyChange(ctx homeassistant.EventMessageContext) StateChange {
+	change := StateChange{
+		UserID:    ctx.UserID,
+		ContextID: ctx.ID,
+		Time:      h.clock.Now(),
+	}
+
+	switch {
+	case h.ownContexts.contains(ctx.ID):
+		change.Cause = CauseHal
+	case ctx.UserID != "" && ctx.UserID == h.config.HomeAssistant.UserID:
+		change.Cause = CauseHal
+	case ctx.UserID != "":
+		change.Cause = CauseUser
+	case ctx.ParentID != "":
+		change.Cause = CauseAutomation
+	default:
+		change.Cause = CauseDevice
+	}
+
+	return change
+}
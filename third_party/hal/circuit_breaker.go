@@ -0,0 +1,135 @@
+package hal
+
+import (
+	"runtime/debug"
+	"time"
+
+	"github.com/dansimau/hal/logger"
+	"github.com/dansimau/hal/store"
+)
+
+const (
+	defaultCircuitBreakerMaxPanics = 3
+	defaultCircuitBreakerWindow    = 10 * time.Minute
+)
+
+// circuitBreaker tracks panics of a single automation and disables it once it
+// has panicked too often.
+type circuitBreaker struct {
+	disabled bool
+	panics   []time.Time
+}
+
+// recordPanic records a panic and returns true if the automation should be
+// disabled as a result.
+func (b *circuitBreaker) recordPanic(now time.Time, maxPanics int, window time.Duration) bool {
+	// Forget panics that are outside the window
+	recent := b.panics[:0]
+	for _, t := range b.panics {
+		if now.Sub(t) < window {
+			recent = append(recent, t)
+		}
+	}
+
+	b.panics = append(recent, now)
+
+	if maxPanics > 0 && len(b.panics) >= maxPanics {
+		b.disabled = true
+	}
+
+	return b.disabled
+}
+
+// runAutomation runs fn on behalf of the automation. A panic is recovered and
+// logged with its stack trace, so that one broken automation doesn't take down
+// the rest of the house. Automations that panic too often are disabled until
+// EnableAutomation is called.
+func (h *Connection) runAutomation(automation registeredAutomation, entityID string, fn func()) {
+	automationName := automation.automation.Name()
+
+	if h.automationDisabled(automation.id) {
+		logger.Warn("Automation disabled after repeated panics, skipping", entityID, "automation", automationName)
+
+		return
+	}
+
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+
+		logger.Error("Automation panicked", entityID, "automation", automationName, "panic", r, "stack", string(debug.Stack()))
+		h.metricsService.RecordCounter(store.MetricTypeAutomationPanic, entityID, automationName)
+
+		if h.recordPanic(automation.id) {
+			logger.Error("Automation disabled after repeated panics", entityID, "automation", automationName)
+		}
+	}()
+
+	fn()
+}
+
+// recordPanic records a panic for the automation with the ID and returns true
+// if it has been disabled.
+func (h *Connection) recordPanic(id int) bool {
+	maxPanics := h.config.CircuitBreaker.MaxPanics
+	if maxPanics == 0 {
+		maxPanics = defaultCircuitBreakerMaxPanics
+	}
+
+	window := h.config.CircuitBreaker.Window
+	if window <= 0 {
+		window = defaultCircuitBreakerWindow
+	}
+
+	h.breakersMutex.Lock()
+	defer h.breakersMutex.Unlock()
+
+	breaker, ok := h.breakers[id]
+	if !ok {
+		breaker = &circuitBreaker{}
+		h.breakers[id] = breaker
+	}
+
+	return breaker.recordPanic(h.clock.Now(), maxPanics, window)
+}
+
+// AutomationDisabled returns true if the automation was disabled after
+// panicking repeatedly. Automations are looked up by identity, so this only
+// works for comparable automations, e.g. pointers.
+func (h *Connection) AutomationDisabled(automation Automation) bool {
+	for _, registered := range h.registeredAs(automation) {
+		if h.automationDisabled(registered.id) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (h *Connection) automationDisabled(id int) bool {
+	h.breakersMutex.Lock()
+	defer h.breakersMutex.Unlock()
+
+	breaker, ok := h.breakers[id]
+
+	return ok && breaker.disabled
+}
+
+// EnableAutomation re-enables an automation that was disabled after
+// panicking repeatedly, and forgets its previous panics. Like
+// AutomationDisabled, it only works for comparable automations.
+func (h *Connection) EnableAutomation(automation Automation) {
+	h.breakersMutex.Lock()
+	defer h.breakersMutex.Unlock()
+
+	for _, registered := range h.registeredAs(automation) {
+		if _, ok := h.breakers[registered.id]; !ok {
+			continue
+		}
+
+		logger.Info("Re-enabling automation", "", "automation", automation.Name())
+		delete(h.breakers, registered.id)
+	}
+}
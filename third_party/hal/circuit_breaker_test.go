@@ -0,0 +1,112 @@
+package hal_test
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/dansimau/hal"
+	"github.com/dansimau/hal/haltest"
+	"github.com/dansimau/hal/homeassistant"
+)
+
+const testSensor = "binary_sensor.test"
+
+// valueAutomation is registered by value and is not comparable, since it
+// holds a slice and a func.
+type valueAutomation struct {
+	entities hal.Entities
+	action   func()
+}
+
+func (a valueAutomation) Name() string                 { return "value automation" }
+func (a valueAutomation) Entities() hal.Entities       { return a.entities }
+func (a valueAutomation) Action(_ hal.EntityInterface) { a.action() }
+
+// startConnection starts a connection with a single binary sensor and the
+// automations returned by automations.
+func startConnection(t *testing.T, automations func(sensor *hal.BinarySensor) []hal.Automation) (*haltest.Harness, *hal.Connection) {
+	t.Helper()
+
+	h := haltest.New(t)
+	h.Seed(homeassistant.State{EntityID: testSensor, State: "off"})
+
+	entities := struct {
+		Sensor *hal.BinarySensor
+	}{
+		Sensor: hal.NewBinarySensor(testSensor),
+	}
+
+	return h, h.StartConnection(&entities, automations(entities.Sensor)...)
+}
+
+func TestCircuitBreakerDisablesPanickingAutomation(t *testing.T) {
+	var runs atomic.Int32
+
+	automation := hal.NewAutomation().
+		WithName("Panics").
+		WithAction(func(_ hal.EntityInterface) {
+			runs.Add(1)
+			panic("broken")
+		})
+
+	h, connection := startConnection(t, func(sensor *hal.BinarySensor) []hal.Automation {
+		return []hal.Automation{automation.WithEntities(sensor)}
+	})
+
+	for _, state := range []string{"on", "off", "on", "off"} {
+		h.SetState(testSensor, state)
+	}
+
+	if n := runs.Load(); n != 3 {
+		t.Errorf("expected the automation to stop running after 3 panics, ran %d times", n)
+	}
+
+	if !connection.AutomationDisabled(automation) {
+		t.Fatal("expected the automation to be disabled")
+	}
+
+	connection.EnableAutomation(automation)
+	h.SetState(testSensor, "on")
+
+	if n := runs.Load(); n != 4 {
+		t.Errorf("expected the automation to run again once enabled, ran %d times", n)
+	}
+}
+
+func TestCircuitBreakerWithIncomparableAutomations(t *testing.T) {
+	var healthyRuns, brokenRuns atomic.Int32
+
+	h, connection := startConnection(t, func(sensor *hal.BinarySensor) []hal.Automation {
+		healthy := valueAutomation{
+			// Listed twice, but only triggered once per change
+			entities: hal.Entities{sensor, sensor},
+			action:   func() { healthyRuns.Add(1) },
+		}
+
+		broken := valueAutomation{
+			entities: hal.Entities{sensor},
+			action: func() {
+				brokenRuns.Add(1)
+				panic("broken")
+			},
+		}
+
+		return []hal.Automation{healthy, broken}
+	})
+
+	for _, state := range []string{"on", "off", "on", "off"} {
+		h.SetState(testSensor, state)
+	}
+
+	if n := healthyRuns.Load(); n != 4 {
+		t.Errorf("expected the healthy automation to run 4 times, ran %d times", n)
+	}
+
+	if n := brokenRuns.Load(); n != 3 {
+		t.Errorf("expected the broken automation to stop running after 3 panics, ran %d times", n)
+	}
+
+	if connection.AutomationDisabled(valueAutomation{}) {
+		t.Error("expected incomparable automations not to be found")
+	}
+}
@@ -0,0 +1,143 @@
+package hal
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"gopkg.in/yaml.v3"
+)
+
+const configFilename = "hal.yaml"
+
+type Config struct {
+	HomeAssistant HomeAssistantConfig `yaml:"homeAssistant"`
+	Location      LocationConfig      `yaml:"location"`
+	DatabasePath  string              `yaml:"databasePath"`
+
+	// StrictValidation refuses to start if any registered entity is unknown
+	// to Home Assistant, has a domain that doesn't match its type, or if an
+	// automation has no entities. Otherwise these are only logged.
+	StrictValidation bool `yaml:"strictValidation"`
+
+	CircuitBreaker CircuitBreakerConfig `yaml:"circuitBreaker"`
+	FlapDetection  FlapDetectionConfig  `yaml:"flapDetection"`
+
+	// UnavailableThreshold is how long an entity can be unavailable before it
+	// is reported in the logs. Unavailable entities are reported after every
+	// state sync, and once per threshold in between (default: 1h).
+	UnavailableThreshold time.Duration `yaml:"unavailableThreshold"`
+
+	// Clock is the source of time for the connection. It can be set to a mock
+	// clock in tests. Defaults to the real clock.
+	Clock clock.Clock `yaml:"-"`
+}
+
+type HomeAssistantConfig struct {
+	Host   string `yaml:"host"`
+	Token  string `yaml:"token"`
+	UserID string `yaml:"userId"`
+
+	// HeartbeatInterval is how often to ping Home Assistant (default: 30s).
+	// Negative values disable the heartbeat, and with it the stale connection
+	// watchdog.
+	HeartbeatInterval time.Duration `yaml:"heartbeatInterval"`
+
+	// StaleConnectionTimeout is how long to wait without receiving a pong or
+	// event before forcing a reconnect (default: 3x HeartbeatInterval,
+	// minimum: 1s).
+	StaleConnectionTimeout time.Duration `yaml:"staleConnectionTimeout"`
+
+	// RequestTimeout is how long to wait for Home Assistant to respond to a
+	// service call that has no deadline of its own (default: 3s).
+	RequestTimeout time.Duration `yaml:"requestTimeout"`
+}
+
+// CircuitBreakerConfig controls when automations that keep panicking are
+// disabled.
+type CircuitBreakerConfig struct {
+	// MaxPanics is the number of panics within Window after which an
+	// automation is disabled (default: 3). Negative values never disable.
+	MaxPanics int `yaml:"maxPanics"`
+
+	// Window is the period over which panics are counted (default: 10m).
+	Window time.Duration `yaml:"window"`
+}
+
+// FlapDetectionConfig controls when an entity that keeps changing state is
+// considered to be flapping. Flapping entities don't trigger automations that
+// detect flapping (see FlapDetector) until they settle, and are reported in
+// the logs and metrics.
+type FlapDetectionConfig struct {
+	// MaxChanges is the number of state changes within Window above which an
+	// entity is flapping (default: 5). Negative values disable detection.
+	MaxChanges int `yaml:"maxChanges"`
+
+	// Window is the period over which changes are counted, and how long a
+	// flapping entity must stay unchanged to settle (default: 10s).
+	Window time.Duration `yaml:"window"`
+}
+
+type LocationConfig struct {
+	Latitude  float64 `yaml:"lat"`
+	Longitude float64 `yaml:"lng"`
+}
+
+func LoadConfig() (*Config, error) {
+	configPath, err := searchParentsForFileFromCwd(configFilename)
+	if err != nil {
+		return nil, err
+	}
+
+	yamlBytes, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	config := Config{}
+	if err := yaml.Unmarshal(yamlBytes, &config); err != nil {
+		return nil, err
+	}
+
+	return &config, nil
+}
+
+func searchParentsForFile(filename, searchPath string) (path string, err error) {
+	for _, path := range getParents(searchPath) {
+		f := filepath.Join(path, filename)
+		if fileExists(f) {
+			return f, nil
+		}
+	}
+
+	return "", nil
+}
+
+func searchParentsForFileFromCwd(filename string) (path string, err error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+
+	return searchParentsForFile(filename, wd)
+}
+
+func getParents(basePath string) (paths []string) {
+	root := basePath
+
+	for root != "/" {
+		paths = append(paths, root)
+		root = filepath.Dir(root)
+	}
+
+	paths = append(paths, "/")
+
+	return paths
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+
+	return !os.IsNotExist(err)
+}
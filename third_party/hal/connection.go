@@ -0,0 +1,979 @@
+package hal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/dansimau/hal/hassws"
+	"github.com/dansimau/hal/homeassistant"
+	"github.com/dansimau/hal/logger"
+	"github.com/dansimau/hal/metrics"
+	"github.com/dansimau/hal/perf"
+	"github.com/dansimau/hal/store"
+	"github.com/google/go-cmp/cmp"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	defaultHeartbeatInterval = 30 * time.Second
+	defaultShutdownTimeout   = 5 * time.Second
+
+	// The watchdog checks the connection three times per stale connection
+	// timeout, so shorter timeouts would make it spin.
+	minStaleConnectionTimeout = time.Second
+)
+
+// Connection is a new instance of the HAL framework. It connects to Home Assistant,
+// listens for state updates and invokes automations when state changes are detected.
+// TODO: Rename "Connection" to something more descriptive.
+type Connection struct {
+	clock  clock.Clock
+	config Config
+	db     *gorm.DB
+
+	automations map[string][]registeredAutomation
+	entities    map[string]EntityInterface
+	timers      map[string]*Timer
+
+	// Latest state of every entity in Home Assistant, including entities
+	// that are not registered. Guarded by mutex.
+	states map[string]homeassistant.State
+
+	// Struct paths that entities were found at, used to report duplicates.
+	entityPaths map[string]string
+
+	// Errors found while registering entities, returned from Start.
+	registrationErrors []error
+
+	// Circuit breakers for automations that panic.
+	breakers      map[int]*circuitBreaker
+	breakersMutex sync.Mutex
+
+	// Flap detection state, keyed by entity ID.
+	flaps      map[string]*flapState
+	flapsMutex sync.Mutex
+
+	// Debounce and throttle state of automations, see limitTrigger.
+	limits      map[limitKey]*limitState
+	limitsMutex sync.Mutex
+
+	// All registered automations, in registration order.
+	registered []registeredAutomation
+
+	// Last ID assigned to an automation, see registeredAutomation.
+	lastAutomationID atomic.Int64
+
+	// Lock to serialize state updates. Automations run outside of it, on
+	// their own queues (see dispatch).
+	mutex sync.RWMutex
+
+	// Per-automation queues that run automations in order without blocking
+	// state updates or each other.
+	queues           map[int]*automationQueue
+	queuesMutex      sync.Mutex
+	pendingJobs      atomic.Int64
+	dispatchStopChan chan struct{}
+
+	// Context IDs of service calls made by hal, used to recognise the state
+	// changes they cause.
+	ownContexts ownContexts
+
+	homeAssistant  *hassws.Client
+	metricsService *metrics.Service
+
+	// Watchdog that forces a reconnect if the connection goes quiet.
+	staleConnectionTimeout time.Duration
+	watchdogStopChan       chan struct{}
+
+	// Time that the last message was received before the connection was lost.
+	outageStart time.Time
+	outageMutex sync.Mutex
+
+	// Events received while states are being synced are buffered and
+	// replayed afterwards, so automations never see a half-synced house.
+	bufferMutex    sync.Mutex
+	buffering      bool
+	bufferedEvents []hassws.EventMessage
+
+	// Number of state change events processed, used to wait for the
+	// connection to settle in tests.
+	eventsProcessed atomic.Uint64
+
+	// Number of reconnects handled, used to wait for reconciliation after a
+	// reconnect in tests.
+	reconnects atomic.Uint64
+
+	// Set during shutdown to stop dispatching events to automations.
+	closing atomic.Bool
+
+	*SunTimes
+}
+
+// ConnectionBinder is an interface that can be implemented by entities to bind
+// them to a connection.
+type ConnectionBinder interface {
+	BindConnection(connection *Connection)
+}
+
+// ClockBinder is an interface that can be implemented by automations that
+// need to tell the time. The connection's clock is bound at registration, so
+// the whole house can be driven by a mock clock in tests.
+type ClockBinder interface {
+	BindClock(clock clock.Clock)
+}
+
+func NewConnection(cfg Config) *Connection {
+	dbPath := cfg.DatabasePath
+	if dbPath == "" {
+		dbPath = "sqlite.db"
+	}
+
+	db, err := store.Open(dbPath)
+	if err != nil {
+		panic(err)
+	}
+
+	heartbeatInterval := cfg.HomeAssistant.HeartbeatInterval
+	if heartbeatInterval == 0 {
+		heartbeatInterval = defaultHeartbeatInterval
+	}
+
+	staleConnectionTimeout := cfg.HomeAssistant.StaleConnectionTimeout
+	if staleConnectionTimeout <= 0 {
+		staleConnectionTimeout = 3 * heartbeatInterval
+	}
+
+	if staleConnectionTimeout < minStaleConnectionTimeout {
+		logger.Warn("Stale connection timeout too short, using minimum", "", "timeout", staleConnectionTimeout, "minimum", minStaleConnectionTimeout)
+		staleConnectionTimeout = minStaleConnectionTimeout
+	}
+
+	clk := cfg.Clock
+	if clk == nil {
+		clk = clock.New()
+	}
+
+	api := hassws.NewClient(hassws.ClientConfig{
+		Host:              cfg.HomeAssistant.Host,
+		Token:             cfg.HomeAssistant.Token,
+		HeartbeatInterval: heartbeatInterval,
+		RequestTimeout:    cfg.HomeAssistant.RequestTimeout,
+		Clock:             clk,
+	})
+
+	// Set the database on the global logger
+	logger.SetDefaultDatabase(db)
+
+	return &Connection{
+		clock:          clk,
+		config:         cfg,
+		db:             db,
+		homeAssistant:  api,
+		metricsService: metrics.NewService(db),
+
+		staleConnectionTimeout: staleConnectionTimeout,
+		watchdogStopChan:       make(chan struct{}),
+		dispatchStopChan:       make(chan struct{}),
+		queues:                 make(map[int]*automationQueue),
+
+		automations: make(map[string][]registeredAutomation),
+		entities:    make(map[string]EntityInterface),
+		entityPaths: make(map[string]string),
+		states:      make(map[string]homeassistant.State),
+		breakers:    make(map[int]*circuitBreaker),
+		flaps:       make(map[string]*flapState),
+		limits:      make(map[limitKey]*limitState),
+		timers:      make(map[string]*Timer),
+
+		SunTimes: NewSunTimes(cfg.Location, clk),
+	}
+}
+
+// Clock returns the source of time used by the connection.
+func (h *Connection) Clock() clock.Clock {
+	return h.clock
+}
+
+// EventsProcessed returns the number of state change events that have been
+// processed since the connection started.
+func (h *Connection) EventsProcessed() uint64 {
+	return h.eventsProcessed.Load()
+}
+
+// Reconnects returns the number of reconnects that have been handled since
+// the connection started. A reconnect counts as handled once the states have
+// been resynced and the automations queued for reconciliation.
+func (h *Connection) Reconnects() uint64 {
+	return h.reconnects.Load()
+}
+
+func (h *Connection) CallService(msg hassws.CallServiceRequest) (hassws.CallServiceResponse, error) {
+	return h.CallServiceContext(context.Background(), msg)
+}
+
+// CallServiceContext calls a service, respecting cancellation and deadlines
+// of the context. Failures reported by Home Assistant are returned as a
+// *hassws.ResultError.
+func (h *Connection) CallServiceContext(ctx context.Context, msg hassws.CallServiceRequest) (hassws.CallServiceResponse, error) {
+	resp, err := h.homeAssistant.CallServiceContext(ctx, msg)
+
+	// A failed call can still have changed some entities. Calls that never
+	// got a result are recognised by hal's user ID instead.
+	h.ownContexts.add(resp.Result.Context.ID, h.clock.Now())
+
+	return resp, err
+}
+
+// GetStates fetches the current state of every entity in Home Assistant,
+// including entities that are not registered.
+func (h *Connection) GetStates() ([]homeassistant.State, error) {
+	return h.homeAssistant.GetStates()
+}
+
+// States returns the latest state of every entity in Home Assistant,
+// including entities that are not registered, sorted by entity ID. Unlike
+// GetStates, it doesn't ask Home Assistant: the states are those of the last
+// sync, kept up to date with the state changes since.
+func (h *Connection) States() []homeassistant.State {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	states := make([]homeassistant.State, 0, len(h.states))
+	for _, state := range h.states {
+		states = append(states, state)
+	}
+
+	slices.SortFunc(states, func(a, b homeassistant.State) int {
+		return strings.Compare(a.EntityID, b.EntityID)
+	})
+
+	return states
+}
+
+// DB returns the database of the connection, for automations that keep
+// records of their own in the store.
+func (h *Connection) DB() *gorm.DB {
+	return h.db
+}
+
+// FindEntities recursively finds and registers all entities in a struct, map, or slice.
+// Each entity ID must be declared once; separate instances with the same ID
+// are reported as an error when the connection starts.
+func (h *Connection) FindEntities(v any) {
+	for _, found := range findEntities(v) {
+		h.registerEntity(found.entity, found.path)
+	}
+}
+
+// RegisterAutomations registers automations and binds them to the relevant entities.
+func (h *Connection) RegisterAutomations(automations ...Automation) {
+	for _, automation := range automations {
+		logger.Info("Registering automation", "", "Name", automation.Name())
+
+		if binder, ok := automation.(ClockBinder); ok {
+			binder.BindClock(h.clock)
+		}
+
+		if binder, ok := automation.(ConnectionBinder); ok {
+			binder.BindConnection(h)
+		}
+
+		registered := h.newRegisteredAutomation(automation)
+		h.registered = append(h.registered, registered)
+
+		if owner, ok := automation.(TimerOwner); ok {
+			h.registerTimers(registered, owner.Timers()...)
+		}
+
+		for _, entity := range automation.Entities() {
+			// Groups are registered under each member, since Home Assistant
+			// reports state changes for the members.
+			for _, entityID := range EntityIDs(entity) {
+				if slices.ContainsFunc(h.automations[entityID], registered.is) {
+					continue
+				}
+
+				h.automations[entityID] = append(h.automations[entityID], registered)
+			}
+		}
+	}
+}
+
+// registeredAutomation is an automation along with the ID it was registered
+// under. Per-automation state (queues, circuit breakers, debounce and
+// throttle) is keyed by the ID, since automations need not be comparable.
+type registeredAutomation struct {
+	id         int
+	automation Automation
+}
+
+func (r registeredAutomation) is(other registeredAutomation) bool {
+	return r.id == other.id
+}
+
+func (h *Connection) newRegisteredAutomation(automation Automation) registeredAutomation {
+	return registeredAutomation{
+		id:         int(h.lastAutomationID.Add(1)),
+		automation: automation,
+	}
+}
+
+// registeredAs returns the registrations of the automation. Automations can
+// only be found if they are comparable, e.g. pointers.
+func (h *Connection) registeredAs(automation Automation) []registeredAutomation {
+	if automation == nil || !reflect.TypeOf(automation).Comparable() {
+		return nil
+	}
+
+	var found []registeredAutomation
+
+	for _, registered := range h.registered {
+		// Automations of other types compare unequal without panicking
+		if registered.automation == automation {
+			found = append(found, registered)
+		}
+	}
+
+	return found
+}
+
+// NewTimer returns a timer that is bound to the connection. The timer's
+// actions run in order on a queue of their own, and if it is named, it is
+// persisted and restored after a restart.
+func (h *Connection) NewTimer(name string) *Timer {
+	timer := NewTimer(h.clock).WithName(name)
+	h.registerTimers(h.newRegisteredAutomation(&timerAutomation{timer: timer}), timer)
+
+	return timer
+}
+
+// registerTimers binds timers to the connection so that named timers are
+// persisted and restored on startup.
+func (h *Connection) registerTimers(owner registeredAutomation, timers ...*Timer) {
+	automationName := owner.automation.Name()
+
+	for _, timer := range timers {
+		timer.automation = automationName
+		timer.owner = owner
+		timer.BindConnection(h)
+
+		if timer.name == "" {
+			continue
+		}
+
+		if _, exists := h.timers[timer.name]; exists {
+			logger.Error("Duplicate timer name, timer will not be restored correctly", "", "timer", timer.name, "automation", automationName)
+		}
+
+		h.timers[timer.name] = timer
+	}
+}
+
+// groupMember returns the light registered under the ID, registering a new
+// light if there isn't one, so that members of Home Assistant light groups
+// receive state updates.
+func (h *Connection) groupMember(entityID string) *Light {
+	if entity, ok := h.entities[entityID]; ok {
+		if light, ok := entity.(*Light); ok {
+			return light
+		}
+
+		logger.Error("Light group member is registered as a different type, its state will not be updated", entityID)
+
+		light := NewLight(entityID)
+		light.BindConnection(h)
+
+		return light
+	}
+
+	light := NewLight(entityID)
+	h.RegisterEntities(light)
+
+	return light
+}
+
+// RegisterEntities registers entities and binds them to the connection.
+func (h *Connection) RegisterEntities(entities ...EntityInterface) {
+	for _, entity := range entities {
+		h.registerEntity(entity, "")
+	}
+}
+
+func (h *Connection) registerEntity(entity EntityInterface, path string) {
+	if group, ok := entity.(LightGroup); ok {
+		for _, member := range group.Members() {
+			h.registerEntity(member, path)
+		}
+
+		return
+	}
+
+	entityID := entity.GetID()
+
+	if existing, ok := h.entities[entityID]; ok {
+		// The same instance can be reachable from several places, e.g. a
+		// light that is also part of a group.
+		if sameEntity(existing, entity) {
+			return
+		}
+
+		err := fmt.Errorf("%w: %s is declared separately at %s and %s, share a single instance instead",
+			ErrDuplicateEntity, entityID, describeEntityPath(h.entityPaths[entityID]), describeEntityPath(path))
+
+		logger.Error("Duplicate entity", entityID, "error", err)
+		h.registrationErrors = append(h.registrationErrors, err)
+
+		return
+	}
+
+	logger.Info("Registering entity", entityID)
+	entity.BindConnection(h)
+	h.entities[entityID] = entity
+	h.entityPaths[entityID] = path
+
+	// Entities can also be automations
+	if automation, ok := entity.(Automation); ok {
+		h.RegisterAutomations(automation)
+	}
+}
+
+func describeEntityPath(path string) string {
+	if path == "" {
+		return "(registered directly)"
+	}
+
+	return path
+}
+
+// Start connects to the Home Assistant websocket and starts listening for events.
+func (h *Connection) Start() error {
+	if err := errors.Join(h.registrationErrors...); err != nil {
+		return err
+	}
+
+	// Start services
+	h.metricsService.Start()
+	logger.StartDefault()
+
+	h.startBuffering()
+
+	if err := h.homeAssistant.Connect(); err != nil {
+		return err
+	}
+
+	if err := h.homeAssistant.SubscribeEvents(string(hassws.MessageTypeStateChanged), h.StateChangeEvent); err != nil {
+		return fmt.Errorf("failed to subscribe to state changed events: %w", err)
+	}
+
+	states, err := h.syncStates()
+	if err != nil {
+		return fmt.Errorf("failed to sync initial states: %w", err)
+	}
+
+	if errs := h.validate(states); len(errs) > 0 && h.config.StrictValidation {
+		return fmt.Errorf("invalid configuration: %w", errors.Join(errs...))
+	}
+
+	h.reportUnavailable()
+
+	// Timers are restored before any events are dispatched to the
+	// automations that own them.
+	overdue, err := h.restoreTimers()
+	if err != nil {
+		return fmt.Errorf("failed to restore timers: %w", err)
+	}
+
+	h.replayBufferedEvents()
+
+	h.reconcile()
+
+	// Timers that were due while hal was down fire after their automations
+	// have reconciled, which may have cancelled them.
+	for _, fire := range overdue {
+		fire()
+	}
+
+	h.homeAssistant.OnDisconnect(func() {
+		// Events that arrive after resubscribing are held back until the
+		// states have been resynced.
+		h.startBuffering()
+
+		h.outageMutex.Lock()
+		h.outageStart = h.homeAssistant.LastMessageReceived()
+		h.outageMutex.Unlock()
+	})
+
+	// Subscriptions are re-issued by the client after a reconnect, but any
+	// state changes missed while disconnected need to be fetched again.
+	h.homeAssistant.OnReconnect(func() {
+		defer h.reconnects.Add(1)
+
+		h.outageMutex.Lock()
+		outage := h.clock.Since(h.outageStart)
+		h.outageMutex.Unlock()
+
+		logger.Info("Connection restored", "", "outage", outage)
+		h.metricsService.RecordTimer(store.MetricTypeConnectionOutage, outage, "", "")
+
+		if _, err := h.syncStates(); err != nil {
+			logger.Error("Failed to resync states after reconnect", "", "error", err)
+			h.replayBufferedEvents()
+
+			return
+		}
+
+		h.replayBufferedEvents()
+		h.reportUnavailable()
+		h.reconcile()
+	})
+
+	// Without a heartbeat, a quiet connection can't be told from a stale one
+	if h.config.HomeAssistant.HeartbeatInterval >= 0 {
+		go h.watchdog()
+	}
+	go h.reportUnavailablePeriodically()
+
+	return nil
+}
+
+// restoreTimers restarts timers that were running when hal last stopped, and
+// returns functions that fire the timers whose deadline passed while hal was
+// down, in the order they were due. Persisted timers that no longer belong to
+// a registered automation are discarded.
+func (h *Connection) restoreTimers() ([]func(), error) {
+	var persisted []store.Timer
+	if err := h.db.Order("deadline").Find(&persisted).Error; err != nil {
+		return nil, err
+	}
+
+	overdue := []func(){}
+
+	for _, row := range persisted {
+		timer, ok := h.timers[row.Name]
+		if !ok {
+			logger.Info("Discarding persisted timer with no registered owner", "", "timer", row.Name, "automation", row.Automation)
+
+			if err := h.db.Delete(&row).Error; err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		if fire := timer.restore(row.Deadline); fire != nil {
+			overdue = append(overdue, fire)
+		}
+	}
+
+	return overdue, nil
+}
+
+// reconcile lets automations catch up on state changes that happened while
+// hal was not connected. Reconciliation is queued behind any state changes the
+// automation is already handling.
+func (h *Connection) reconcile() {
+	if h.closing.Load() {
+		return
+	}
+
+	for _, registered := range h.registered {
+		if reconciler, ok := registered.automation.(Reconciler); ok {
+			logger.Info("Reconciling automation", "", "automation", registered.automation.Name())
+			h.dispatch(registered, "", reconciler.Reconcile)
+		}
+	}
+}
+
+// watchdog forces a reconnect if nothing (not even a heartbeat pong) has been
+// received from Home Assistant within the stale connection timeout. This
+// detects half-open connections that would otherwise never error.
+func (h *Connection) watchdog() {
+	ticker := h.clock.Ticker(h.staleConnectionTimeout / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.watchdogStopChan:
+			return
+		case <-ticker.C:
+			lastReceived := h.homeAssistant.LastMessageReceived()
+			if h.clock.Since(lastReceived) < h.staleConnectionTimeout {
+				continue
+			}
+
+			logger.Error("Connection stale, reconnecting", "", "last_received", lastReceived)
+			h.homeAssistant.Reconnect()
+		}
+	}
+}
+
+// Close shuts down the connection, waiting up to defaultShutdownTimeout for
+// in-flight automations to finish.
+func (h *Connection) Close() {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultShutdownTimeout)
+	defer cancel()
+
+	if err := h.Shutdown(ctx); err != nil {
+		logger.Error("Error during shutdown", "", "error", err)
+	}
+}
+
+// Shutdown gracefully shuts down the connection. It stops dispatching events,
+// waits for in-flight automations to finish (or the context to expire),
+// closes the websocket cleanly and flushes the database.
+func (h *Connection) Shutdown(ctx context.Context) error {
+	if !h.closing.CompareAndSwap(false, true) {
+		return nil
+	}
+
+	logger.Info("Shutting down", "")
+
+	// Drop state changes that are being held back
+	h.stopLimitTimers()
+	h.stopFlapTimers()
+
+	var errs []error
+
+	// Wait for any state update that is in progress and for queued
+	// automations to finish
+	idle := make(chan struct{})
+
+	go func() {
+		if h.waitForAutomations(ctx) {
+			close(idle)
+		}
+	}()
+
+	select {
+	case <-idle:
+	case <-ctx.Done():
+		errs = append(errs, fmt.Errorf("timed out waiting for automations to finish: %w", ctx.Err()))
+	}
+
+	close(h.dispatchStopChan)
+	close(h.watchdogStopChan)
+
+	if err := h.homeAssistant.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("failed to close websocket: %w", err))
+	}
+
+	h.metricsService.Stop()
+	logger.StopDefault()
+
+	// Detach the logger from the database before closing it; any further log
+	// lines are buffered in memory.
+	logger.SetDefaultDatabase(nil)
+
+	if sqlDB, err := h.db.DB(); err != nil {
+		errs = append(errs, err)
+	} else if err := sqlDB.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("failed to close database: %w", err))
+	}
+
+	return errors.Join(errs...)
+}
+
+// waitForAutomations waits until no state update is in progress and no
+// automations are queued or running. It returns false if the context expires
+// first.
+func (h *Connection) waitForAutomations(ctx context.Context) bool {
+	for {
+		h.mutex.Lock()
+		idle := h.pendingJobs.Load() == 0
+		h.mutex.Unlock()
+
+		if idle {
+			return true
+		}
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(shutdownPollInterval):
+		}
+	}
+}
+
+func (h *Connection) syncStates() ([]homeassistant.State, error) {
+	defer perf.Timer(func(timeTaken time.Duration) {
+		logger.Info("Initial state sync complete", "", "duration", timeTaken)
+	})()
+
+	states, err := h.homeAssistant.GetStates()
+	if err != nil {
+		return nil, err
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.states = make(map[string]homeassistant.State, len(states))
+
+	var unregistered []homeassistant.State
+
+	for _, state := range states {
+		h.states[state.EntityID] = state
+
+		entity, ok := h.entities[state.EntityID]
+		if !ok {
+			unregistered = append(unregistered, state)
+
+			continue
+		}
+
+		logger.Debug("Setting initial state", state.EntityID, "State", state)
+
+		entity.SetState(state)
+	}
+
+	// Members of light groups are registered when the group state is set,
+	// which may be after their own state was skipped.
+	for _, state := range unregistered {
+		if entity, ok := h.entities[state.EntityID]; ok {
+			logger.Debug("Setting initial state", state.EntityID, "State", state)
+
+			entity.SetState(state)
+		}
+	}
+
+	return states, nil
+}
+
+// startBuffering holds back incoming state change events until
+// replayBufferedEvents is called.
+func (h *Connection) startBuffering() {
+	h.bufferMutex.Lock()
+	defer h.bufferMutex.Unlock()
+
+	h.buffering = true
+}
+
+// bufferEvent buffers the event if a state sync is in progress. It returns
+// false if the event should be processed straight away.
+func (h *Connection) bufferEvent(event hassws.EventMessage) bool {
+	h.bufferMutex.Lock()
+	defer h.bufferMutex.Unlock()
+
+	if !h.buffering {
+		return false
+	}
+
+	h.bufferedEvents = append(h.bufferedEvents, event)
+
+	return true
+}
+
+// replayBufferedEvents processes events that were buffered during a state
+// sync, in the order they were received, and then stops buffering.
+func (h *Connection) replayBufferedEvents() {
+	for {
+		h.bufferMutex.Lock()
+
+		events := h.bufferedEvents
+		h.bufferedEvents = nil
+
+		if len(events) == 0 {
+			h.buffering = false
+			h.bufferMutex.Unlock()
+
+			return
+		}
+
+		h.bufferMutex.Unlock()
+
+		logger.Info("Replaying events received during state sync", "", "count", len(events))
+
+		for _, event := range events {
+			h.handleStateChangeEvent(event)
+		}
+	}
+}
+
+// isStaleEvent returns true if the known state of the entity is newer than
+// the event, or is the state from the event, i.e. the event is already
+// reflected in it. This happens to events that raced a state sync, which may
+// be handled after the sync even if they were received before it finished.
+// Unregistered entities are checked too, so that States() doesn't go back to
+// an older state.
+func (h *Connection) isStaleEvent(event hassws.EventMessage) bool {
+	newState := event.Event.EventData.NewState
+	if newState == nil || newState.LastUpdated.IsZero() {
+		return false
+	}
+
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	synced, ok := h.states[event.Event.EventData.EntityID]
+	if !ok {
+		return false
+	}
+
+	if newState.LastUpdated.Equal(synced.LastUpdated) {
+		return newState.State == synced.State && reflect.DeepEqual(newState.Attributes, synced.Attributes)
+	}
+
+	return newState.LastUpdated.Before(synced.LastUpdated)
+}
+
+// Process incoming state change events. Dispatch state change to the relevant
+// entity and fire any automations listening for state changes to this entity.
+// Events received while states are being synced are buffered.
+func (h *Connection) StateChangeEvent(event hassws.EventMessage) {
+	if h.bufferEvent(event) {
+		return
+	}
+
+	h.handleStateChangeEvent(event)
+}
+
+func (h *Connection) handleStateChangeEvent(event hassws.EventMessage) {
+	if h.closing.Load() {
+		return
+	}
+
+	if h.isStaleEvent(event) {
+		logger.Debug("Dropping event older than synced state", event.Event.EventData.EntityID)
+		h.eventsProcessed.Add(1)
+
+		return
+	}
+
+	defer perf.Timer(func(timeTaken time.Duration) {
+		logger.Debug("Tick processing time", event.Event.EventData.EntityID, "duration", timeTaken)
+		// Record tick processing time metric
+		h.metricsService.RecordTimer(store.MetricTypeTickProcessingTime, timeTaken, event.Event.EventData.EntityID, "")
+		h.eventsProcessed.Add(1)
+	})()
+
+	entity, change, automations := h.applyStateChange(event)
+	if entity == nil {
+		return
+	}
+
+	trigger := Trigger{
+		Entity: entity,
+		Change: change,
+	}
+
+	if event.Event.EventData.OldState != nil {
+		trigger.OldState = *event.Event.EventData.OldState
+	}
+
+	if event.Event.EventData.NewState != nil {
+		trigger.NewState = *event.Event.EventData.NewState
+	}
+
+	// Flapping entities don't trigger automations that detect flapping until
+	// they settle
+	detectors := slices.DeleteFunc(slices.Clone(automations), func(registered registeredAutomation) bool {
+		return !detectsFlapping(registered)
+	})
+
+	if h.checkFlapping(trigger, detectors) {
+		automations = slices.DeleteFunc(slices.Clone(automations), detectsFlapping)
+	}
+
+	h.triggerAutomations(automations, trigger)
+}
+
+// triggerAutomations dispatches the trigger to each automation, subject to
+// the automation's debounce and throttle.
+func (h *Connection) triggerAutomations(automations []registeredAutomation, trigger Trigger) {
+	for _, automation := range automations {
+		h.limitTrigger(automation, trigger)
+	}
+}
+
+// dispatchTrigger queues the automation to run for the trigger.
+func (h *Connection) dispatchTrigger(registered registeredAutomation, trigger Trigger) {
+	entityID := trigger.Entity.GetID()
+	automation := registered.automation
+
+	logger.Info("Running automation", entityID, "name", automation.Name())
+	// Record automation triggered metric
+	h.metricsService.RecordCounter(store.MetricTypeAutomationTriggered, entityID, automation.Name())
+	h.dispatch(registered, entityID, func() {
+		if handler, ok := automation.(TriggerHandler); ok {
+			handler.HandleTrigger(trigger)
+
+			return
+		}
+
+		automation.Action(trigger.Entity)
+	})
+}
+
+// applyStateChange updates the state of the entity and returns it, along with
+// what caused the change and the automations that should be triggered by it.
+func (h *Connection) applyStateChange(event hassws.EventMessage) (EntityInterface, StateChange, []registeredAutomation) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.closing.Load() {
+		return nil, StateChange{}, nil
+	}
+
+	if newState := event.Event.EventData.NewState; newState != nil {
+		h.states[event.Event.EventData.EntityID] = *newState
+	} else {
+		delete(h.states, event.Event.EventData.EntityID)
+	}
+
+	entity, ok := h.entities[event.Event.EventData.EntityID]
+	if !ok {
+		logger.Debug("Entity not registered", event.Event.EventData.EntityID)
+
+		return nil, StateChange{}, nil
+	}
+
+	logger.Debug("State changed for", event.Event.EventData.EntityID)
+
+	fmt.Fprintf(os.Stderr, "Diff:\n%s\n", cmp.Diff(event.Event.EventData.OldState, event.Event.EventData.NewState))
+
+	if event.Event.EventData.NewState != nil {
+		entity.SetState(*event.Event.EventData.NewState)
+
+		// Before automations are dispatched, so they see the result
+		if observer, ok := entity.(stateChangeObserver); ok {
+			observer.stateChanged()
+		}
+	}
+
+	// Update database
+	h.db.Clauses(clause.OnConflict{
+		UpdateAll: true,
+	}).Create(&store.Entity{
+		ID:    event.Event.EventData.EntityID,
+		Type:  entity.GetID(),
+		State: event.Event.EventData.NewState,
+	})
+
+	change := h.classifyChange(event.Event.Context)
+	change.Echo = isEcho(LastChange(entity), change, stateChanged(event.Event.EventData))
+
+	if recorder, ok := entity.(changeRecorder); ok {
+		recorder.setLastChange(change)
+	}
+
+	logger.Debug("State change cause", event.Event.EventData.EntityID, "cause", change.Cause.String(), "user", change.UserID, "echo", change.Echo)
+
+	// Prevent loops by not running automations that originate from hal
+	if change.Cause == CauseHal {
+		logger.Debug("Skipping automation from own action", event.Event.EventData.EntityID)
+
+		return entity, change, nil
+	}
+
+	return entity, change, h.automations[event.Event.EventData.EntityID]
+}
@@ -0,0 +1,188 @@
+package hal_test
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dansimau/hal"
+	"github.com/dansimau/hal/haltest"
+	"github.com/dansimau/hal/homeassistant"
+	"github.com/dansimau/hal/store"
+)
+
+// startRecordingConnection starts a connection with an automation that
+// records the states of the test sensor it is triggered with.
+func startRecordingConnection(t *testing.T) (*haltest.Harness, *hal.Connection, *hal.BinarySensor, *stateRecorder) {
+	t.Helper()
+
+	recorder := &stateRecorder{}
+
+	var sensor *hal.BinarySensor
+
+	h, connection := startConnection(t, func(s *hal.BinarySensor) []hal.Automation {
+		sensor = s
+
+		return []hal.Automation{
+			hal.NewAutomation().
+				WithName("Recorder").
+				WithEntities(s).
+				WithTriggerAction(recorder.record),
+		}
+	})
+
+	return h, connection, sensor, recorder
+}
+
+func TestEventsDuringReconnectAreAppliedAfterResync(t *testing.T) {
+	h, _, sensor, recorder := startRecordingConnection(t)
+
+	// Without buffering, the synced states would overwrite the newer event
+	h.Server.SetDuringSync(func() {
+		h.Clock.Add(time.Second)
+		h.Server.SetState(testSensor, "on", nil)
+
+		// Give the event time to be handled before the states arrive
+		time.Sleep(50 * time.Millisecond)
+	})
+	h.Reconnect()
+
+	if !sensor.IsOn() {
+		t.Errorf("expected the sensor to be on, got %q", sensor.GetState().State)
+	}
+
+	recorder.assert(t, "on")
+}
+
+func TestEventsDuringSyncAreReplayedInOrder(t *testing.T) {
+	h, _, sensor, recorder := startRecordingConnection(t)
+
+	h.Server.SetDuringSync(func() {
+		for _, state := range []string{"on", "off", "on"} {
+			h.Clock.Add(time.Second)
+			h.Server.SetState(testSensor, state, nil)
+		}
+	})
+	h.Reconnect()
+
+	if !sensor.IsOn() {
+		t.Errorf("expected the sensor to be on, got %q", sensor.GetState().State)
+	}
+
+	recorder.assert(t, "on", "off", "on")
+}
+
+func TestEventsOlderThanSyncedStateAreDropped(t *testing.T) {
+	const battery = "sensor.test_battery"
+
+	h, connection, sensor, recorder := startRecordingConnection(t)
+
+	h.Advance(time.Minute)
+	h.Server.SeedStates(homeassistant.State{EntityID: battery, State: "40"})
+
+	// Events from before the states were synced, for a registered and an
+	// unregistered entity
+	h.Server.SetDuringSync(func() {
+		for entityID, state := range map[string]string{testSensor: "on", battery: "50"} {
+			h.Server.SendEvent(homeassistant.Event{
+				EventType: homeassistant.EventTypeStateChanged,
+				EventData: homeassistant.EventData{
+					EntityID: entityID,
+					NewState: &homeassistant.State{
+						EntityID:    entityID,
+						State:       state,
+						LastChanged: haltest.StartTime.Add(-time.Minute),
+						LastUpdated: haltest.StartTime.Add(-time.Minute),
+					},
+				},
+			})
+		}
+	})
+	h.Reconnect()
+
+	if sensor.IsOn() {
+		t.Error("expected the sensor to keep its synced state")
+	}
+
+	recorder.assert(t)
+
+	states := connection.States()
+
+	i := slices.IndexFunc(states, func(state homeassistant.State) bool {
+		return state.EntityID == battery
+	})
+	if i < 0 || states[i].State != "40" {
+		t.Errorf("expected %s to keep its synced state, got %+v", battery, states)
+	}
+}
+
+type testRoom struct {
+	Light *hal.Light
+}
+
+type testHouse struct {
+	Kitchen testRoom
+	Hallway testRoom
+}
+
+func TestDuplicateEntityFailsStartWithBothPaths(t *testing.T) {
+	h := haltest.New(t)
+	h.Seed(homeassistant.State{EntityID: "light.shared", State: "off"})
+
+	// Two separate instances of the same light
+	house := testHouse{
+		Kitchen: testRoom{Light: hal.NewLight("light.shared")},
+		Hallway: testRoom{Light: hal.NewLight("light.shared")},
+	}
+
+	err := tryStartConnection(t, h.Config(), &house)
+	if !errors.Is(err, hal.ErrDuplicateEntity) {
+		t.Fatalf("expected %v, got %v", hal.ErrDuplicateEntity, err)
+	}
+
+	for _, path := range []string{"testHouse.Kitchen.Light", "testHouse.Hallway.Light"} {
+		if !strings.Contains(err.Error(), path) {
+			t.Errorf("expected the error to mention %s, got: %v", path, err)
+		}
+	}
+}
+
+func TestWatchdogReconnectsSilentConnection(t *testing.T) {
+	h := haltest.New(t)
+
+	config := h.Config()
+	config.HomeAssistant.HeartbeatInterval = 10 * time.Second
+	config.HomeAssistant.StaleConnectionTimeout = 30 * time.Second
+
+	connection := hal.NewConnection(config)
+	h.Start(connection)
+
+	// The connection stays open, but nothing comes back
+	h.Server.SetIgnorePings(true)
+
+	for range 4 {
+		h.Clock.Add(10 * time.Second)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+
+	for connection.Reconnects() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the watchdog to reconnect")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var outages []store.Metric
+	if err := connection.DB().Where("metric_type = ?", store.MetricTypeConnectionOutage).Find(&outages).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if len(outages) != 1 || time.Duration(outages[0].Value) < 30*time.Second {
+		t.Errorf("expected an outage of at least 30s to be recorded, got %+v", outages)
+	}
+}
@@ -0,0 +1,156 @@
+package hal
+
+import (
+	"sync"
+	"time"
+
+	"github.com/dansimau/hal/logger"
+	"github.com/dansimau/hal/store"
+)
+
+const (
+	shutdownPollInterval = 10 * time.Millisecond
+
+	// Number of queued jobs at which an automation is reported as falling
+	// behind.
+	queueBacklogWarning = 100
+
+	// How often the queue depth of an automation is recorded, at most. A
+	// busy automation would otherwise write a metric for every job.
+	queueDepthSampleInterval = 10 * time.Second
+)
+
+// automationJob is a single invocation of an automation, e.g. handling a
+// state change.
+type automationJob struct {
+	entityID string
+	enqueued time.Time
+	run      func()
+}
+
+// automationQueue runs the jobs for one automation in order, on its own
+// goroutine, so that a slow automation doesn't hold up any other.
+type automationQueue struct {
+	automation registeredAutomation
+	connection *Connection
+	name       string
+
+	mutex sync.Mutex
+	jobs  []automationJob
+	wake  chan struct{}
+
+	// When the queue depth was last recorded.
+	depthSampled time.Time
+}
+
+func newAutomationQueue(connection *Connection, automation registeredAutomation) *automationQueue {
+	q := &automationQueue{
+		automation: automation,
+		connection: connection,
+		name:       automation.automation.Name(),
+		wake:       make(chan struct{}, 1),
+	}
+
+	go q.run()
+
+	return q
+}
+
+func (q *automationQueue) enqueue(job automationJob) {
+	q.mutex.Lock()
+	q.jobs = append(q.jobs, job)
+	depth := len(q.jobs)
+
+	sample := q.depthSampled.IsZero() || job.enqueued.Sub(q.depthSampled) >= queueDepthSampleInterval
+	if sample {
+		q.depthSampled = job.enqueued
+	}
+
+	q.mutex.Unlock()
+
+	if sample {
+		q.connection.metricsService.RecordGauge(store.MetricTypeAutomationQueueDepth, int64(depth), job.entityID, q.name)
+	}
+
+	if depth == queueBacklogWarning {
+		logger.Warn("Automation is falling behind", job.entityID, "automation", q.name, "queued", depth)
+	}
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *automationQueue) next() (automationJob, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if len(q.jobs) == 0 {
+		return automationJob{}, false
+	}
+
+	job := q.jobs[0]
+	q.jobs = q.jobs[1:]
+
+	return job, true
+}
+
+func (q *automationQueue) run() {
+	for {
+		select {
+		case <-q.wake:
+		case <-q.connection.dispatchStopChan:
+			return
+		}
+
+		for {
+			// Jobs still queued after a shutdown timed out are dropped, rather
+			// than run against a closed database and websocket
+			select {
+			case <-q.connection.dispatchStopChan:
+				return
+			default:
+			}
+
+			job, ok := q.next()
+			if !ok {
+				break
+			}
+
+			wait := q.connection.clock.Since(job.enqueued)
+			logger.Debug("Running queued automation", job.entityID, "automation", q.name, "wait", wait)
+			q.connection.metricsService.RecordTimer(store.MetricTypeAutomationQueueWait, wait, job.entityID, q.name)
+
+			q.connection.runAutomation(q.automation, job.entityID, job.run)
+			q.connection.pendingJobs.Add(-1)
+		}
+	}
+}
+
+// dispatch queues fn to run on the automation's queue. Jobs for the same
+// automation run in the order they were dispatched.
+func (h *Connection) dispatch(automation registeredAutomation, entityID string, fn func()) {
+	h.queuesMutex.Lock()
+
+	queue, ok := h.queues[automation.id]
+	if !ok {
+		queue = newAutomationQueue(h, automation)
+		h.queues[automation.id] = queue
+	}
+
+	h.queuesMutex.Unlock()
+
+	h.pendingJobs.Add(1)
+	queue.enqueue(automationJob{
+		entityID: entityID,
+		enqueued: h.clock.Now(),
+		run:      fn,
+	})
+}
+
+// PendingAutomations returns the number of automation invocations that are
+// queued or running.
+func (h *Connection) PendingAutomations() int64 {
+	return h.pendingJobs.Load()
+}
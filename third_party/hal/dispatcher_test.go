@@ -0,0 +1,135 @@
+package hal
+
+import (
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/dansimau/hal/logger"
+	"github.com/dansimau/hal/store"
+)
+
+// newTestConnection returns a connection that is never started, for
+// exercising the dispatcher directly.
+func newTestConnection(t *testing.T) (*Connection, *clock.Mock) {
+	t.Helper()
+
+	mockClock := clock.NewMock()
+
+	h := NewConnection(Config{
+		DatabasePath: filepath.Join(t.TempDir(), "sqlite.db"),
+		Clock:        mockClock,
+	})
+
+	t.Cleanup(func() {
+		logger.SetDefaultDatabase(nil)
+
+		if sqlDB, err := h.db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+
+	return h, mockClock
+}
+
+// waitFor polls until the condition is true, failing the test if it takes
+// too long.
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDispatcherMeasuresQueueWaitWithClock(t *testing.T) {
+	h, mockClock := newTestConnection(t)
+	automation := h.newRegisteredAutomation(NewAutomation().WithName("Test"))
+
+	release := make(chan struct{})
+
+	h.dispatch(automation, "", func() { <-release })
+	h.dispatch(automation, "", func() {})
+
+	mockClock.Add(5 * time.Second)
+	close(release)
+
+	waitFor(t, "queued jobs", func() bool { return h.PendingAutomations() == 0 })
+
+	var waits []store.Metric
+	if err := h.db.Where("metric_type = ?", store.MetricTypeAutomationQueueWait).Order("id").Find(&waits).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if len(waits) != 2 {
+		t.Fatalf("expected 2 queue wait metrics, got %d", len(waits))
+	}
+
+	if wait := time.Duration(waits[1].Value); wait != 5*time.Second {
+		t.Errorf("expected the second job to wait 5s on the clock, got %s", wait)
+	}
+}
+
+func TestDispatcherDropsQueuedJobsAfterStop(t *testing.T) {
+	h, _ := newTestConnection(t)
+	automation := h.newRegisteredAutomation(NewAutomation().WithName("Test"))
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	var ran atomic.Bool
+
+	h.dispatch(automation, "", func() {
+		close(started)
+		<-release
+	})
+	h.dispatch(automation, "", func() { ran.Store(true) })
+
+	<-started
+	close(h.dispatchStopChan)
+	close(release)
+
+	// The first job is done once it is no longer pending
+	waitFor(t, "the running job", func() bool { return h.PendingAutomations() == 1 })
+	time.Sleep(10 * time.Millisecond)
+
+	if ran.Load() {
+		t.Error("expected the queued job to be dropped after stop")
+	}
+}
+
+func TestDispatcherSamplesQueueDepth(t *testing.T) {
+	h, mockClock := newTestConnection(t)
+	automation := h.newRegisteredAutomation(NewAutomation().WithName("Test"))
+
+	release := make(chan struct{})
+
+	h.dispatch(automation, "", func() { <-release })
+	h.dispatch(automation, "", func() {})
+	h.dispatch(automation, "", func() {})
+
+	mockClock.Add(queueDepthSampleInterval)
+	h.dispatch(automation, "", func() {})
+
+	close(release)
+	waitFor(t, "queued jobs", func() bool { return h.PendingAutomations() == 0 })
+
+	var depths []store.Metric
+	if err := h.db.Where("metric_type = ?", store.MetricTypeAutomationQueueDepth).Order("id").Find(&depths).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// The first job may already have been taken off the queue by the time
+	// the last one is queued
+	if len(depths) != 2 || depths[0].Value != 1 || depths[1].Value < 3 {
+		t.Errorf("expected depth to be sampled once per interval, got %+v", depths)
+	}
+}
@@ -0,0 +1,330 @@
+package hal
+
+import (
+	"fmt"
+	"maps"
+	"reflect"
+	"sync/atomic"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/dansimau/hal/homeassistant"
+)
+
+// EntityInterface is the interface that we accept which allows us to create
+// custom components that embed an Entity.
+type EntityInterface interface {
+	ConnectionBinder
+
+	GetID() string
+	GetState() homeassistant.State
+	SetState(event homeassistant.State)
+}
+
+type Entities []EntityInterface
+
+// LastChanged returns the most recent time any of the entities changed state.
+func (e Entities) LastChanged() time.Time {
+	var lastChanged time.Time
+
+	for _, entity := range e {
+		if changed := entity.GetState().LastChanged; changed.After(lastChanged) {
+			lastChanged = changed
+		}
+	}
+
+	return lastChanged
+}
+
+// Entity is a base type for all entities that can be embedded into other types.
+type Entity struct {
+	connection *Connection
+
+	// State is written by the connection and read by automations and timers,
+	// which run on their own goroutines. Each state is an immutable snapshot
+	// that is swapped in atomically, so readers always see a consistent state.
+	state atomic.Pointer[homeassistant.State]
+
+	// What caused the last state change.
+	change atomic.Pointer[StateChange]
+
+	// When the entity became unavailable, nil while it is available.
+	unavailableSince atomic.Pointer[time.Time]
+}
+
+func NewEntity(id string) *Entity {
+	e := &Entity{}
+	e.state.Store(&homeassistant.State{EntityID: id})
+
+	return e
+}
+
+// BindConnection binds the entity to the connection. This allows entities to
+// publish messages.
+func (e *Entity) BindConnection(connection *Connection) {
+	e.connection = connection
+}
+
+// getClock returns the clock of the connection the entity is bound to, or the
+// real clock if it is not bound.
+func (e *Entity) getClock() clock.Clock {
+	if e.connection == nil {
+		return clock.New()
+	}
+
+	return e.connection.clock
+}
+
+func (e *Entity) GetID() string {
+	return e.GetState().EntityID
+}
+
+// SetState replaces the state of the entity with a snapshot of the given
+// state. The attributes are copied, so later changes to the caller's map are
+// not visible to readers.
+func (e *Entity) SetState(state homeassistant.State) {
+	state.Attributes = maps.Clone(state.Attributes)
+
+	e.state.Store(&state)
+	e.updateAvailability(state)
+}
+
+// GetState returns the current state snapshot of the entity. The attributes
+// are shared with other readers and must not be modified.
+func (e *Entity) GetState() homeassistant.State {
+	state := e.state.Load()
+	if state == nil {
+		return homeassistant.State{}
+	}
+
+	return *state
+}
+
+// LastChange returns what caused the last state change of the entity. Entities
+// that haven't changed since the connection started report CauseDevice.
+func (e *Entity) LastChange() StateChange {
+	change := e.change.Load()
+	if change == nil {
+		return StateChange{}
+	}
+
+	return *change
+}
+
+func (e *Entity) setLastChange(change StateChange) {
+	e.change.Store(&change)
+}
+
+// changeRecorder is implemented by entities that embed an Entity, so the
+// connection can record what caused their state changes.
+type changeRecorder interface {
+	setLastChange(change StateChange)
+}
+
+// stateChangeObserver is implemented by entities that keep track of their own
+// state changes, e.g. buttons counting presses.
+type stateChangeObserver interface {
+	stateChanged()
+}
+
+// LastChange returns what caused the last state change of an entity, e.g. to
+// tell if a light was switched by a person or by hal.
+func LastChange(entity EntityInterface) StateChange {
+	changer, ok := entity.(interface{ LastChange() StateChange })
+	if !ok {
+		return StateChange{}
+	}
+
+	return changer.LastChange()
+}
+
+// EntityIDs returns the IDs of the Home Assistant entities that make up the
+// entity. For a LightGroup this is the ID of each member; for any other entity
+// it is just its own ID.
+func EntityIDs(entity EntityInterface) []string {
+	group, ok := entity.(LightGroup)
+	if !ok {
+		return []string{entity.GetID()}
+	}
+
+	members := group.Members()
+
+	ids := make([]string, len(members))
+	for i, member := range members {
+		ids[i] = member.GetID()
+	}
+
+	return ids
+}
+
+// foundEntity is an entity found by findEntities, along with the path of the
+// struct field it was found in (e.g. "Marnixkade.LivingRoom.ArcherLamp").
+type foundEntity struct {
+	entity EntityInterface
+	path   string
+}
+
+// EntitiesIn recursively finds all entities in a struct, map, or slice, like
+// Connection.FindEntities, but without registering them. Light groups are
+// expanded into their members and each entity ID is returned once.
+func EntitiesIn(v any) Entities {
+	entities := Entities{}
+	seen := map[string]bool{}
+
+	for _, found := range findEntities(v) {
+		entityID := found.entity.GetID()
+		if seen[entityID] {
+			continue
+		}
+
+		seen[entityID] = true
+		entities = append(entities, found.entity)
+	}
+
+	return entities
+}
+
+// findEntities recursively finds all entities in a struct, map, or slice.
+func findEntities(v any) []foundEntity {
+	value := reflect.ValueOf(v)
+	if value.Kind() == reflect.Ptr {
+		value = value.Elem()
+	}
+
+	if value.Kind() != reflect.Struct {
+		return nil
+	}
+
+	return findEntitiesAt(v, value.Type().Name())
+}
+
+func findEntitiesAt(v any, path string) []foundEntity {
+	var entities []foundEntity
+
+	value := reflect.ValueOf(v)
+	if value.Kind() == reflect.Ptr {
+		value = value.Elem()
+	}
+
+	if value.Kind() != reflect.Struct {
+		return entities
+	}
+
+	valueType := value.Type()
+
+	for i := range value.NumField() {
+		field := value.Field(i)
+		fieldType := field.Type()
+		fieldPath := path + "." + valueType.Field(i).Name
+
+		// Skip unexported fields
+		if !valueType.Field(i).IsExported() {
+			continue
+		}
+
+		// Check if field implements EntityLike interface
+		if entity, ok := asEntity(field); ok {
+			entities = append(entities, withPath(entity, fieldPath)...)
+
+			continue
+		}
+
+		// Recursively check for nested structs, maps, and slices
+		switch fieldType.Kind() {
+		case reflect.Struct:
+			if field.CanInterface() {
+				entities = append(entities, findEntitiesAt(field.Interface(), fieldPath)...)
+			}
+		case reflect.Ptr:
+			if !field.IsNil() && field.CanInterface() {
+				entities = append(entities, findEntitiesAt(field.Interface(), fieldPath)...)
+			}
+		case reflect.Map:
+			if !field.IsNil() && field.CanInterface() {
+				for _, key := range field.MapKeys() {
+					mapValue := field.MapIndex(key)
+					mapPath := fmt.Sprintf("%s[%v]", fieldPath, key.Interface())
+
+					if entity, ok := asEntity(mapValue); ok {
+						entities = append(entities, withPath(entity, mapPath)...)
+					} else if mapValue.CanInterface() {
+						entities = append(entities, findEntitiesAt(mapValue.Interface(), mapPath)...)
+					}
+				}
+			}
+		case reflect.Slice:
+			if !field.IsNil() && field.CanInterface() {
+				for i := range field.Len() {
+					sliceValue := field.Index(i)
+					slicePath := fmt.Sprintf("%s[%d]", fieldPath, i)
+
+					if entity, ok := asEntity(sliceValue); ok {
+						entities = append(entities, withPath(entity, slicePath)...)
+					} else if sliceValue.CanInterface() {
+						entities = append(entities, findEntitiesAt(sliceValue.Interface(), slicePath)...)
+					}
+				}
+			}
+		default:
+			// Ignore other types
+		}
+	}
+
+	return entities
+}
+
+func withPath(entities []EntityInterface, path string) []foundEntity {
+	found := make([]foundEntity, len(entities))
+	for i, entity := range entities {
+		found[i] = foundEntity{entity: entity, path: path}
+	}
+
+	return found
+}
+
+// sameEntity returns true if both entities are the same instance.
+func sameEntity(a, b EntityInterface) bool {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	if va.Kind() != reflect.Ptr || vb.Kind() != reflect.Ptr {
+		return false
+	}
+
+	return va.Type() == vb.Type() && va.Pointer() == vb.Pointer()
+}
+
+// asEntity returns the entities held by a value if it is an entity. Light
+// groups are expanded into their members, since groups only exist in hal and
+// Home Assistant reports state changes for each member.
+func asEntity(value reflect.Value) ([]EntityInterface, bool) {
+	if !value.CanInterface() {
+		return nil, false
+	}
+
+	if value.Kind() == reflect.Interface || value.Kind() == reflect.Ptr {
+		if value.IsNil() {
+			return nil, false
+		}
+	}
+
+	if group, ok := value.Interface().(LightGroup); ok {
+		members := group.Members()
+
+		entities := make([]EntityInterface, len(members))
+		for i, member := range members {
+			entities[i] = member
+		}
+
+		return entities, true
+	}
+
+	if value.Kind() != reflect.Ptr && value.Kind() != reflect.Interface {
+		return nil, false
+	}
+
+	entity, ok := value.Interface().(EntityInterface)
+	if !ok {
+		return nil, false
+	}
+
+	return []EntityInterface{entity}, true
+}
@@ -0,0 +1,74 @@
+package hal
+
+import (
+	"sync"
+	"time"
+
+	"github.com/dansimau/hal/logger"
+)
+
+// buttonPressTimeout is the amount of time to listen for repeat presses.
+const buttonPressTimeout = 2 * time.Second
+
+// Button is an event entity that represents a button.
+type Button struct {
+	*Entity
+
+	mutex        sync.RWMutex
+	lastPressed  time.Time
+	pressedTimes int32
+}
+
+func NewButton(id string) *Button {
+	return &Button{Entity: NewEntity(id)}
+}
+
+// Domains returns the Home Assistant domains a button can represent.
+func (b *Button) Domains() []string {
+	return []string{"event"}
+}
+
+// Name, Entities and Action implement Automation, so that buttons registered
+// as automations keep working. Presses are counted as the state changes, see
+// stateChanged, so Action has nothing left to do.
+func (b *Button) Name() string {
+	return b.GetID()
+}
+
+func (b *Button) Entities() Entities {
+	return Entities{b}
+}
+
+func (b *Button) Action(_ EntityInterface) {}
+
+// stateChanged counts presses. It is called by the connection when the
+// button's state changes, before any automations are triggered, so they see
+// the new count.
+func (b *Button) stateChanged() {
+	if b.Entity.GetState().Attributes["event_type"] != "initial_press" {
+		return
+	}
+
+	clock := b.getClock()
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if clock.Since(b.lastPressed) < buttonPressTimeout {
+		b.pressedTimes++
+	} else {
+		b.pressedTimes = 1
+	}
+
+	entityID := b.GetID()
+	logger.Info("Button pressed", entityID, "times", b.pressedTimes)
+
+	b.lastPressed = clock.Now()
+}
+
+func (b *Button) PressedTimes() int32 {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	return b.pressedTimes
+}
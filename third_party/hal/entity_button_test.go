@@ -0,0 +1,39 @@
+package hal_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dansimau/hal"
+	"github.com/dansimau/hal/haltest"
+	"github.com/dansimau/hal/homeassistant"
+)
+
+const testButton = "event.test_button"
+
+func TestButtonRegisteredAsAutomationCountsPressesOnce(t *testing.T) {
+	h := haltest.New(t)
+	h.Seed(homeassistant.State{EntityID: testButton, State: "2024-06-01T08:00:00Z"})
+
+	entities := struct {
+		Button *hal.Button
+	}{
+		Button: hal.NewButton(testButton),
+	}
+
+	h.StartConnection(&entities, entities.Button)
+
+	h.FireEvent(testButton, "initial_press")
+	h.FireEvent(testButton, "initial_press")
+
+	if n := entities.Button.PressedTimes(); n != 2 {
+		t.Errorf("expected 2 presses, got %d", n)
+	}
+
+	h.Advance(5 * time.Second)
+	h.FireEvent(testButton, "initial_press")
+
+	if n := entities.Button.PressedTimes(); n != 1 {
+		t.Errorf("expected the count to start over after a pause, got %d", n)
+	}
+}
@@ -0,0 +1,564 @@
+package hal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/dansimau/hal/hassws"
+	"github.com/dansimau/hal/homeassistant"
+	"github.com/dansimau/hal/logger"
+)
+
+type LightInterface interface {
+	EntityInterface
+
+	GetBrightness() float64
+	IsOn() bool
+	TurnOn(attributes ...map[string]any) error
+	TurnOnContext(ctx context.Context, attributes ...map[string]any) error
+	TurnOff() error
+	TurnOffContext(ctx context.Context) error
+}
+
+type Light struct {
+	*Entity
+
+	// Members of the light if it is a Home Assistant light group, kept in
+	// sync with the group's entity_id attribute.
+	members      []*Light
+	membersMutex sync.RWMutex
+}
+
+func NewLight(id string) *Light {
+	return &Light{Entity: NewEntity(id)}
+}
+
+// Domains returns the Home Assistant domains a light can represent.
+func (l *Light) Domains() []string {
+	return []string{"light"}
+}
+
+func (l *Light) GetBrightness() float64 {
+	if v, ok := l.Entity.GetState().Attributes["brightness"].(float64); ok {
+		return v
+	}
+
+	return 0
+}
+
+func (l *Light) IsOn() bool {
+	return l.Entity.GetState().State == "on"
+}
+
+// SetState sets the state of the light. If the light is a Home Assistant
+// light group, its members are updated from the entity_id attribute.
+func (l *Light) SetState(state homeassistant.State) {
+	l.Entity.SetState(state)
+	l.updateMembers()
+}
+
+// IsGroup returns true if the light is a Home Assistant light group.
+func (l *Light) IsGroup() bool {
+	return len(l.getMembers()) > 0
+}
+
+func (l *Light) getMembers() []*Light {
+	l.membersMutex.RLock()
+	defer l.membersMutex.RUnlock()
+
+	return l.members
+}
+
+// Members returns the member lights if the light is a Home Assistant light
+// group, or nil otherwise. Members are registered with the connection, so
+// their state is kept up to date.
+func (l *Light) Members() []LightInterface {
+	lights := l.getMembers()
+	if len(lights) == 0 {
+		return nil
+	}
+
+	members := make([]LightInterface, len(lights))
+	for i, member := range lights {
+		members[i] = member
+	}
+
+	return members
+}
+
+// AnyOn returns true if the light is on or, for a light group, if any member
+// is on.
+func (l *Light) AnyOn() bool {
+	for _, member := range l.getMembers() {
+		if member.IsOn() {
+			return true
+		}
+	}
+
+	return l.IsOn()
+}
+
+// updateMembers syncs the members of a light group with the entity_id
+// attribute reported by Home Assistant.
+func (l *Light) updateMembers() {
+	memberIDs := getStringOrStringSlice(l.Entity.GetState().Attributes["entity_id"])
+
+	if slices.EqualFunc(memberIDs, l.getMembers(), func(id string, member *Light) bool {
+		return id == member.GetID()
+	}) {
+		return
+	}
+
+	members := make([]*Light, len(memberIDs))
+	for i, memberID := range memberIDs {
+		if l.connection == nil {
+			members[i] = NewLight(memberID)
+
+			continue
+		}
+
+		members[i] = l.connection.groupMember(memberID)
+	}
+
+	logger.Info("Light group members updated", l.GetID(), "members", memberIDs)
+
+	l.membersMutex.Lock()
+	l.members = members
+	l.membersMutex.Unlock()
+}
+
+func (l *Light) TurnOn(attributes ...map[string]any) error {
+	return l.TurnOnContext(context.Background(), attributes...)
+}
+
+// TurnOnContext turns on the light. The call is abandoned if the context is
+// cancelled or its deadline passes.
+func (l *Light) TurnOnContext(ctx context.Context, attributes ...map[string]any) error {
+	entityID := l.GetID()
+	if l.connection == nil {
+		logger.Error("Light not registered", entityID)
+
+		return ErrEntityNotRegistered
+	}
+
+	logger.Debug("Turning on light", entityID)
+
+	err := l.connection.callLightService(ctx, "turn_on", []string{entityID}, mergeAttributes(attributes...))
+	if err != nil {
+		entityID := l.GetID()
+		logger.Error("Error turning on light", entityID, "error", err)
+
+		return err
+	}
+
+	return nil
+}
+
+func (l *Light) TurnOff() error {
+	return l.TurnOffContext(context.Background())
+}
+
+// TurnOffContext turns off the light. The call is abandoned if the context is
+// cancelled or its deadline passes.
+func (l *Light) TurnOffContext(ctx context.Context) error {
+	entityID := l.GetID()
+	if l.connection == nil {
+		logger.Error("Light not registered", entityID)
+
+		return ErrEntityNotRegistered
+	}
+
+	logger.Info("Turning off light", entityID)
+
+	err := l.connection.callLightService(ctx, "turn_off", []string{entityID}, nil)
+	if err != nil {
+		entityID := l.GetID()
+		logger.Error("Error turning off light", entityID, "error", err)
+
+		return err
+	}
+
+	return nil
+}
+
+// LightGroup is a set of lights that are switched together. The group is on
+// only if every light is on, both for IsOn and GetState; use AnyOn to check
+// whether any light is.
+type LightGroup []LightInterface
+
+func (lg LightGroup) BindConnection(connection *Connection) {
+	for _, l := range lg {
+		l.BindConnection(connection)
+	}
+}
+
+func (lg LightGroup) GetID() string {
+	if len(lg) == 0 {
+		return "(empty light group)"
+	}
+
+	ids := make([]string, len(lg))
+	for i, l := range lg {
+		ids[i] = l.GetID()
+	}
+
+	return strings.Join(ids, ", ")
+}
+
+// Members returns the individual lights in the group, with nested groups
+// expanded.
+func (lg LightGroup) Members() []LightInterface {
+	return flattenLights(lg)
+}
+
+// GetBrightness returns the mean brightness of the members that are on.
+func (lg LightGroup) GetBrightness() float64 {
+	var (
+		total float64
+		on    int
+	)
+
+	for _, l := range lg.Members() {
+		if l.IsOn() {
+			total += l.GetBrightness()
+			on++
+		}
+	}
+
+	if on == 0 {
+		return 0
+	}
+
+	return total / float64(on)
+}
+
+// GetState returns the aggregate state of the group. It is derived from the
+// members on every call, so it always reflects their latest state: the group
+// is "on" if every member is on, like IsOn, has the mean brightness of the
+// members, and was last changed when any member last changed.
+func (lg LightGroup) GetState() homeassistant.State {
+	members := lg.Members()
+	if len(members) == 0 {
+		return homeassistant.State{}
+	}
+
+	state := homeassistant.State{
+		EntityID: lg.GetID(),
+		State:    "off",
+	}
+
+	for _, l := range members {
+		memberState := l.GetState()
+
+		if memberState.LastChanged.After(state.LastChanged) {
+			state.LastChanged = memberState.LastChanged
+		}
+
+		if memberState.LastUpdated.After(state.LastUpdated) {
+			state.LastUpdated = memberState.LastUpdated
+		}
+	}
+
+	if lg.AllOn() {
+		state.State = "on"
+		state.Attributes = map[string]any{"brightness": lg.GetBrightness()}
+	}
+
+	return state
+}
+
+func (lg LightGroup) SetState(state homeassistant.State) {
+	for _, l := range lg {
+		l.SetState(state)
+	}
+}
+
+// IsOn returns true if all lights in the group are on. See also AnyOn.
+func (lg LightGroup) IsOn() bool {
+	return lg.AllOn()
+}
+
+// AllOn returns true if all lights in the group are on.
+func (lg LightGroup) AllOn() bool {
+	for _, l := range lg.Members() {
+		if !l.IsOn() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// AnyOn returns true if at least one light in the group is on.
+func (lg LightGroup) AnyOn() bool {
+	for _, l := range lg.Members() {
+		if l.IsOn() {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (lg LightGroup) TurnOn(attributes ...map[string]any) error {
+	return lg.TurnOnContext(context.Background(), attributes...)
+}
+
+// TurnOnContext turns on all lights in the group with a single service call.
+func (lg LightGroup) TurnOnContext(ctx context.Context, attributes ...map[string]any) error {
+	return TurnOnLights(ctx, LightTurnOn{Light: lg, Attributes: mergeAttributes(attributes...)})
+}
+
+func (lg LightGroup) TurnOff() error {
+	return lg.TurnOffContext(context.Background())
+}
+
+// TurnOffContext turns off all lights in the group with a single service call.
+func (lg LightGroup) TurnOffContext(ctx context.Context) error {
+	return TurnOffLights(ctx, lg)
+}
+
+// LightTurnOn is a request to turn on a light (or light group) with the given
+// attributes.
+type LightTurnOn struct {
+	Light      LightInterface
+	Attributes map[string]any
+}
+
+// lightBatch is a set of lights that can be switched with one service call.
+type lightBatch struct {
+	connection *Connection
+	attributes map[string]any
+	entityIDs  []string
+}
+
+// TurnOnLights turns on several lights. Lights with identical attributes are
+// coalesced into a single service call, so that they switch on together.
+func TurnOnLights(ctx context.Context, requests ...LightTurnOn) error {
+	var (
+		batches []*lightBatch
+		errs    []error
+	)
+
+	batchesByKey := map[string]*lightBatch{}
+
+	for _, request := range requests {
+		for _, light := range flattenLights(request.Light) {
+			l, ok := light.(*Light)
+			if !ok {
+				// Custom light types are switched individually
+				if err := light.TurnOnContext(ctx, request.Attributes); err != nil {
+					errs = append(errs, &EntityError{EntityID: light.GetID(), Err: err})
+				}
+
+				continue
+			}
+
+			if l.connection == nil {
+				logger.Error("Light not registered", l.GetID())
+				errs = append(errs, &EntityError{EntityID: l.GetID(), Err: ErrEntityNotRegistered})
+
+				continue
+			}
+
+			key, err := json.Marshal(request.Attributes)
+			if err != nil {
+				errs = append(errs, &EntityError{EntityID: l.GetID(), Err: err})
+
+				continue
+			}
+
+			batchKey := fmt.Sprintf("%p/%s", l.connection, key)
+
+			batch, ok := batchesByKey[batchKey]
+			if !ok {
+				batch = &lightBatch{connection: l.connection, attributes: request.Attributes}
+				batchesByKey[batchKey] = batch
+				batches = append(batches, batch)
+			}
+
+			batch.entityIDs = append(batch.entityIDs, l.GetID())
+		}
+	}
+
+	for _, batch := range batches {
+		logger.Debug("Turning on lights", "", "entities", batch.entityIDs, "attributes", batch.attributes)
+
+		if err := batch.connection.callLightServiceBatch(ctx, "turn_on", batch.entityIDs, batch.attributes); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return joinErrors(errs)
+}
+
+// TurnOffLights turns off several lights with a single service call.
+func TurnOffLights(ctx context.Context, lights ...LightInterface) error {
+	var (
+		batches []*lightBatch
+		errs    []error
+	)
+
+	batchesByConnection := map[*Connection]*lightBatch{}
+
+	for _, light := range lights {
+		for _, light := range flattenLights(light) {
+			l, ok := light.(*Light)
+			if !ok {
+				if err := light.TurnOffContext(ctx); err != nil {
+					errs = append(errs, &EntityError{EntityID: light.GetID(), Err: err})
+				}
+
+				continue
+			}
+
+			if l.connection == nil {
+				logger.Error("Light not registered", l.GetID())
+				errs = append(errs, &EntityError{EntityID: l.GetID(), Err: ErrEntityNotRegistered})
+
+				continue
+			}
+
+			batch, ok := batchesByConnection[l.connection]
+			if !ok {
+				batch = &lightBatch{connection: l.connection}
+				batchesByConnection[l.connection] = batch
+				batches = append(batches, batch)
+			}
+
+			batch.entityIDs = append(batch.entityIDs, l.GetID())
+		}
+	}
+
+	for _, batch := range batches {
+		logger.Info("Turning off lights", "", "entities", batch.entityIDs)
+
+		if err := batch.connection.callLightServiceBatch(ctx, "turn_off", batch.entityIDs, nil); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return joinErrors(errs)
+}
+
+// callLightServiceBatch calls a light service for several entities at once.
+// If Home Assistant rejects the call, it is retried for each entity
+// individually so that errors can be attributed to the entities that caused
+// them.
+func (h *Connection) callLightServiceBatch(ctx context.Context, service string, entityIDs []string, attributes map[string]any) error {
+	err := h.callLightService(ctx, service, entityIDs, attributes)
+	if err == nil {
+		return nil
+	}
+
+	var resultErr *hassws.ResultError
+	if len(entityIDs) == 1 || !errors.As(err, &resultErr) {
+		errs := make([]error, len(entityIDs))
+		for i, entityID := range entityIDs {
+			logger.Error("Error calling light service", entityID, "service", service, "error", err)
+			errs[i] = &EntityError{EntityID: entityID, Err: err}
+		}
+
+		return joinErrors(errs)
+	}
+
+	var errs []error
+
+	for _, entityID := range entityIDs {
+		if err := h.callLightService(ctx, service, []string{entityID}, attributes); err != nil {
+			logger.Error("Error calling light service", entityID, "service", service, "error", err)
+			errs = append(errs, &EntityError{EntityID: entityID, Err: err})
+		}
+	}
+
+	return joinErrors(errs)
+}
+
+// callLightService calls a light service for the specified entities.
+func (h *Connection) callLightService(ctx context.Context, service string, entityIDs []string, attributes map[string]any) error {
+	data := map[string]any{
+		"entity_id": entityIDs,
+	}
+
+	for k, v := range attributes {
+		data[k] = v
+	}
+
+	_, err := h.CallServiceContext(ctx, hassws.CallServiceRequest{
+		Type:    hassws.MessageTypeCallService,
+		Domain:  "light",
+		Service: service,
+		Data:    data,
+	})
+
+	return err
+}
+
+// ExpandLights expands light groups, both LightGroups and Home Assistant light
+// groups, into their individual lights.
+func ExpandLights(lights ...LightInterface) []LightInterface {
+	var expanded []LightInterface
+
+	for _, light := range lights {
+		for _, light := range flattenLights(light) {
+			if group, ok := light.(*Light); ok && group.IsGroup() {
+				expanded = append(expanded, ExpandLights(group.Members()...)...)
+
+				continue
+			}
+
+			expanded = append(expanded, light)
+		}
+	}
+
+	return expanded
+}
+
+// flattenLights expands light groups (including nested groups) into their
+// individual lights.
+func flattenLights(light LightInterface) []LightInterface {
+	group, ok := light.(LightGroup)
+	if !ok {
+		return []LightInterface{light}
+	}
+
+	var lights []LightInterface
+	for _, l := range group {
+		lights = append(lights, flattenLights(l)...)
+	}
+
+	return lights
+}
+
+// mergeAttributes merges multiple attribute maps into one. Later maps take
+// precedence.
+func mergeAttributes(attributes ...map[string]any) map[string]any {
+	if len(attributes) == 0 {
+		return nil
+	}
+
+	merged := map[string]any{}
+
+	for _, attribute := range attributes {
+		for k, v := range attribute {
+			merged[k] = v
+		}
+	}
+
+	return merged
+}
+
+func joinErrors(errs []error) error {
+	if len(errs) == 1 {
+		return errs[0]
+	} else if len(errs) > 1 {
+		return errors.Join(errs...)
+	}
+
+	return nil
+}
@@ -0,0 +1,25 @@
+package hal
+
+import "strconv"
+
+type LightSensor struct {
+	*Entity
+}
+
+func NewLightSensor(id string) *LightSensor {
+	return &LightSensor{Entity: NewEntity(id)}
+}
+
+// Domains returns the Home Assistant domains a light sensor can represent.
+func (s *LightSensor) Domains() []string {
+	return []string{"sensor"}
+}
+
+func (s *LightSensor) Level() int {
+	v, err := strconv.Atoi(s.GetState().State)
+	if err != nil {
+		return 0
+	}
+
+	return v
+}
@@ -0,0 +1,222 @@
+package hal_test
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/dansimau/hal"
+	"github.com/dansimau/hal/haltest"
+	"github.com/dansimau/hal/hassws"
+	"github.com/dansimau/hal/homeassistant"
+)
+
+func TestLightGroupOnMeansAllOn(t *testing.T) {
+	left := hal.NewLight("light.left")
+	right := hal.NewLight("light.right")
+	group := hal.LightGroup{left, right}
+
+	left.SetState(homeassistant.State{EntityID: "light.left", State: "on"})
+	right.SetState(homeassistant.State{EntityID: "light.right", State: "off"})
+
+	if group.IsOn() {
+		t.Error("expected IsOn to be false with one light off")
+	}
+
+	if !group.AnyOn() {
+		t.Error("expected AnyOn to be true with one light on")
+	}
+
+	if state := group.GetState().State; state != "off" {
+		t.Errorf("expected the group state to agree with IsOn, got %q", state)
+	}
+
+	right.SetState(homeassistant.State{EntityID: "light.right", State: "on"})
+
+	if !group.IsOn() {
+		t.Error("expected IsOn to be true with all lights on")
+	}
+
+	if state := group.GetState().State; state != "on" {
+		t.Errorf("expected the group state to be on with all lights on, got %q", state)
+	}
+}
+
+// startLights starts a connection with lights that are off.
+func startLights(t *testing.T, entityIDs ...string) (*haltest.Harness, hal.LightGroup) {
+	t.Helper()
+
+	h := haltest.New(t)
+
+	lights := make(hal.LightGroup, len(entityIDs))
+	for i, entityID := range entityIDs {
+		h.Seed(homeassistant.State{EntityID: entityID, State: "off"})
+		lights[i] = hal.NewLight(entityID)
+	}
+
+	h.StartConnection(&struct{ Lights hal.LightGroup }{lights})
+
+	return h, lights
+}
+
+func TestTurnOnLightsCoalescesIntoOneCall(t *testing.T) {
+	h, lights := startLights(t, "light.a", "light.b", "light.c")
+
+	if err := lights.TurnOn(map[string]any{"brightness": 100}); err != nil {
+		t.Fatalf("failed to turn on lights: %v", err)
+	}
+
+	calls := h.ServiceCalls()
+	if len(calls) != 1 {
+		t.Fatalf("expected one service call, got %+v", calls)
+	}
+
+	if call := calls[0]; call.Domain+"."+call.Service != "light.turn_on" ||
+		!slices.Equal(call.EntityIDs, []string{"light.a", "light.b", "light.c"}) ||
+		call.Data["brightness"] != float64(100) {
+		t.Errorf("expected light.turn_on for all lights at brightness 100, got %+v", call)
+	}
+}
+
+func TestTurnOnLightsBatchesByAttributes(t *testing.T) {
+	h, lights := startLights(t, "light.a", "light.b", "light.c")
+
+	err := hal.TurnOnLights(context.Background(),
+		hal.LightTurnOn{Light: lights[0], Attributes: map[string]any{"brightness": 100}},
+		hal.LightTurnOn{Light: lights[1], Attributes: map[string]any{"brightness": 50}},
+		hal.LightTurnOn{Light: lights[2], Attributes: map[string]any{"brightness": 100}},
+	)
+	if err != nil {
+		t.Fatalf("failed to turn on lights: %v", err)
+	}
+
+	calls := h.ServiceCalls()
+	if len(calls) != 2 {
+		t.Fatalf("expected two service calls, got %+v", calls)
+	}
+
+	if !slices.Equal(calls[0].EntityIDs, []string{"light.a", "light.c"}) || calls[0].Data["brightness"] != float64(100) {
+		t.Errorf("expected light.a and light.c at brightness 100, got %+v", calls[0])
+	}
+
+	if !slices.Equal(calls[1].EntityIDs, []string{"light.b"}) || calls[1].Data["brightness"] != float64(50) {
+		t.Errorf("expected light.b at brightness 50, got %+v", calls[1])
+	}
+}
+
+func TestRejectedLightBatchFallsBackToPerEntityCalls(t *testing.T) {
+	h, lights := startLights(t, "light.a", "light.b")
+
+	h.Server.SetServiceError("light.turn_on", &hassws.ResultError{Code: "invalid_format", Message: "rejected"})
+
+	err := lights.TurnOn()
+
+	var resultErr *hassws.ResultError
+	if !errors.As(err, &resultErr) {
+		t.Fatalf("expected a result error, got %v", err)
+	}
+
+	var entityIDs [][]string
+	for _, call := range h.ServiceCalls() {
+		entityIDs = append(entityIDs, call.EntityIDs)
+	}
+
+	expected := [][]string{{"light.a", "light.b"}, {"light.a"}, {"light.b"}}
+	if !slices.EqualFunc(entityIDs, expected, slices.Equal) {
+		t.Errorf("expected a batch call and then one call per light, got %v", entityIDs)
+	}
+
+	// Each light is named in the error
+	for _, light := range lights {
+		if !strings.Contains(err.Error(), light.GetID()+": ") {
+			t.Errorf("expected the error to mention %s, got: %v", light.GetID(), err)
+		}
+	}
+}
+
+// startLightGroup starts a connection with a Home Assistant light group of
+// two lights that are on at different brightnesses. Only the group is
+// registered.
+func startLightGroup(t *testing.T) (*haltest.Harness, *hal.Light) {
+	t.Helper()
+
+	h := haltest.New(t)
+	h.Seed(
+		homeassistant.State{EntityID: "light.group", State: "on", Attributes: map[string]any{
+			"entity_id": []any{"light.a", "light.b"},
+		}},
+		homeassistant.State{EntityID: "light.a", State: "on", Attributes: map[string]any{"brightness": 200}},
+		homeassistant.State{EntityID: "light.b", State: "on", Attributes: map[string]any{"brightness": 100}},
+		homeassistant.State{EntityID: "light.c", State: "off"},
+	)
+
+	group := hal.NewLight("light.group")
+	h.StartConnection(&struct{ Group *hal.Light }{group})
+
+	return h, group
+}
+
+func memberIDs(light *hal.Light) []string {
+	var ids []string
+	for _, member := range light.Members() {
+		ids = append(ids, member.GetID())
+	}
+
+	return ids
+}
+
+func TestLightGroupMembersAreRegisteredDuringSync(t *testing.T) {
+	_, group := startLightGroup(t)
+
+	if !group.IsGroup() {
+		t.Fatal("expected a light with an entity_id attribute to be a group")
+	}
+
+	if ids := memberIDs(group); !slices.Equal(ids, []string{"light.a", "light.b"}) {
+		t.Fatalf("expected light.a and light.b as members, got %v", ids)
+	}
+
+	// Members get their own synced state, whichever order the states arrive in
+	for i, brightness := range []float64{200, 100} {
+		if member := group.Members()[i]; member.GetBrightness() != brightness {
+			t.Errorf("expected %s to be at brightness %v, got %+v", member.GetID(), brightness, member.GetState())
+		}
+	}
+}
+
+func TestLightGroupMembersFollowEntityIDAttribute(t *testing.T) {
+	h, group := startLightGroup(t)
+
+	h.SetState("light.group", "on", map[string]any{"entity_id": []any{"light.a", "light.b", "light.c"}})
+
+	if ids := memberIDs(group); !slices.Equal(ids, []string{"light.a", "light.b", "light.c"}) {
+		t.Fatalf("expected light.c to be added to the members, got %v", ids)
+	}
+
+	if group.Members()[2].IsOn() {
+		t.Error("expected the new member to have its state from Home Assistant")
+	}
+
+	h.SetState("light.c", "on")
+
+	if !group.Members()[2].IsOn() {
+		t.Error("expected the new member to receive state updates")
+	}
+}
+
+func TestExpandLightsExpandsHomeAssistantGroups(t *testing.T) {
+	_, group := startLightGroup(t)
+
+	lights := hal.ExpandLights(hal.LightGroup{group})
+
+	var ids []string
+	for _, light := range lights {
+		ids = append(ids, light.GetID())
+	}
+
+	if !slices.Equal(ids, []string{"light.a", "light.b"}) {
+		t.Errorf("expected the group to be expanded into light.a and light.b, got %v", ids)
+	}
+}
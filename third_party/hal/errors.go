@@ -0,0 +1,23 @@
+package hal
+
+import "errors"
+
+var (
+	ErrDuplicateEntity     = errors.New("duplicate entity")
+	ErrEntityNotRegistered = errors.New("entity not registered")
+)
+
+// EntityError attributes an error to a specific entity, for operations that
+// act on several entities at once.
+type EntityError struct {
+	EntityID string
+	Err      error
+}
+
+func (e *EntityError) Error() string {
+	return e.EntityID + ": " + e.Err.Error()
+}
+
+func (e *EntityError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,192 @@
+package hal
+
+import (
+	"slices"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/dansimau/hal/logger"
+	"github.com/dansimau/hal/store"
+)
+
+const (
+	defaultFlapMaxChanges = 5
+	defaultFlapWindow     = 10 * time.Second
+)
+
+// FlapDetector is an interface that can be implemented by automations that
+// should not be triggered by entities that keep switching back and forth,
+// e.g. a presence sensor with a failing radio. While an entity is flapping,
+// these automations are held back. Once it settles, they are triggered with
+// its latest change. Other automations see every change.
+type FlapDetector interface {
+	DetectFlapping() bool
+}
+
+// detectsFlapping returns true if the automation opted in to flap detection.
+func detectsFlapping(registered registeredAutomation) bool {
+	detector, ok := registered.automation.(FlapDetector)
+
+	return ok && detector.DetectFlapping()
+}
+
+// flapState tracks the recent state changes of a single entity, to detect
+// sensors that keep switching back and forth.
+type flapState struct {
+	changes  []time.Time
+	flapping bool
+
+	// Latest change while flapping, delivered once the entity settles.
+	latest      Trigger
+	automations []registeredAutomation
+	settleTimer *clock.Timer
+}
+
+// recordChange records a state change and returns true if the entity has
+// changed state more than maxChanges times within the window.
+func (f *flapState) recordChange(now time.Time, maxChanges int, window time.Duration) bool {
+	// Forget changes that are outside the window
+	recent := f.changes[:0]
+	for _, t := range f.changes {
+		if now.Sub(t) < window {
+			recent = append(recent, t)
+		}
+	}
+
+	f.changes = append(recent, now)
+
+	return maxChanges > 0 && len(f.changes) > maxChanges
+}
+
+func (h *Connection) flapLimits() (int, time.Duration) {
+	maxChanges := h.config.FlapDetection.MaxChanges
+	if maxChanges == 0 {
+		maxChanges = defaultFlapMaxChanges
+	}
+
+	window := h.config.FlapDetection.Window
+	if window <= 0 {
+		window = defaultFlapWindow
+	}
+
+	return maxChanges, window
+}
+
+// checkFlapping records the state change and returns true if the entity is
+// flapping, in which case the automations must not be triggered. Once a
+// flapping entity has not changed state for the flap window, the automations
+// are triggered with the latest change. Changes are only recorded for
+// entities with automations that detect flapping.
+func (h *Connection) checkFlapping(trigger Trigger, automations []registeredAutomation) bool {
+	if len(automations) == 0 {
+		return false
+	}
+
+	// Attribute updates don't count as flapping
+	if !trigger.StateChanged() {
+		h.flapsMutex.Lock()
+		defer h.flapsMutex.Unlock()
+
+		flap, ok := h.flaps[trigger.Entity.GetID()]
+		if ok && flap.flapping {
+			flap.latest = trigger
+			flap.automations = automations
+
+			return true
+		}
+
+		return false
+	}
+
+	maxChanges, window := h.flapLimits()
+	entityID := trigger.Entity.GetID()
+	now := h.clock.Now()
+
+	h.flapsMutex.Lock()
+	defer h.flapsMutex.Unlock()
+
+	flap, ok := h.flaps[entityID]
+	if !ok {
+		flap = &flapState{}
+		h.flaps[entityID] = flap
+	}
+
+	if !flap.recordChange(now, maxChanges, window) && !flap.flapping {
+		return false
+	}
+
+	if !flap.flapping {
+		flap.flapping = true
+
+		logger.Warn("Entity is flapping, holding back automations until it settles", entityID, "changes", len(flap.changes), "window", window.String())
+		h.metricsService.RecordCounter(store.MetricTypeEntityFlapping, entityID, "")
+	}
+
+	flap.latest = trigger
+	flap.automations = automations
+
+	if flap.settleTimer != nil {
+		flap.settleTimer.Stop()
+	}
+
+	flap.settleTimer = h.clock.AfterFunc(window, func() {
+		h.flapSettled(entityID)
+	})
+
+	return true
+}
+
+// flapSettled ends flapping for an entity that has stopped changing, and
+// triggers its automations with the latest change. The lock is held until the
+// change is dispatched, so a newer change can't be dispatched before it.
+func (h *Connection) flapSettled(entityID string) {
+	h.flapsMutex.Lock()
+	defer h.flapsMutex.Unlock()
+
+	flap, ok := h.flaps[entityID]
+	if !ok || !flap.flapping {
+		return
+	}
+
+	flap.flapping = false
+	flap.changes = nil
+	flap.settleTimer = nil
+
+	if h.closing.Load() {
+		return
+	}
+
+	logger.Info("Entity stopped flapping", entityID, "state", flap.latest.NewState.State)
+
+	h.triggerAutomations(flap.automations, flap.latest)
+}
+
+// FlappingEntities returns the IDs of entities that are currently flapping.
+func (h *Connection) FlappingEntities() []string {
+	h.flapsMutex.Lock()
+	defer h.flapsMutex.Unlock()
+
+	entityIDs := []string{}
+
+	for entityID, flap := range h.flaps {
+		if flap.flapping {
+			entityIDs = append(entityIDs, entityID)
+		}
+	}
+
+	slices.Sort(entityIDs)
+
+	return entityIDs
+}
+
+// stopFlapTimers stops pending flap settle timers.
+func (h *Connection) stopFlapTimers() {
+	h.flapsMutex.Lock()
+	defer h.flapsMutex.Unlock()
+
+	for _, flap := range h.flaps {
+		if flap.settleTimer != nil {
+			flap.settleTimer.Stop()
+		}
+	}
+}
@@ -0,0 +1,297 @@
+// Package haltest provides a harness for running scenario tests of a home
+// against an in-process fake Home Assistant with a mock clock.
+package haltest
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/dansimau/hal"
+	"github.com/dansimau/hal/hassws"
+	"github.com/dansimau/hal/homeassistant"
+)
+
+const (
+	token  = "haltest-token"
+	userID = "haltest-user"
+
+	settleInterval   = 10 * time.Millisecond
+	settleTimeout    = 5 * time.Second
+	reconnectTimeout = 10 * time.Second
+)
+
+// StartTime is the time the mock clock starts at: midday on a fixed date, so
+// that scenarios don't depend on when they are run.
+var StartTime = time.Date(2024, time.June, 3, 12, 0, 0, 0, time.UTC)
+
+// Harness runs a hal.Connection against a fake Home Assistant server. Tests
+// change sensor states, advance the mock clock and then assert on the service
+// calls that were made.
+type Harness struct {
+	Clock  *clock.Mock
+	Server *hassws.Server
+
+	config     hal.Config
+	connection *hal.Connection
+	tb         testing.TB
+
+	// Number of events sent by the server before the current connection
+	// was started.
+	eventsBefore int
+}
+
+// New starts a fake Home Assistant server and returns a harness for it. The
+// mock clock starts at StartTime.
+func New(tb testing.TB) *Harness {
+	tb.Helper()
+
+	server, err := hassws.NewServer(map[string]string{token: userID})
+	if err != nil {
+		tb.Fatalf("failed to start fake Home Assistant: %v", err)
+	}
+
+	tb.Cleanup(func() {
+		_ = server.Shutdown()
+	})
+
+	mockClock := clock.NewMock()
+	mockClock.Set(StartTime)
+	server.SetClock(mockClock)
+
+	return &Harness{
+		Clock:  mockClock,
+		Server: server,
+		config: hal.Config{
+			HomeAssistant: hal.HomeAssistantConfig{
+				Host:   server.ListenAddress(),
+				Token:  token,
+				UserID: userID,
+
+				// The mock clock jumps ahead faster than pings can be
+				// answered, so the heartbeat and the stale connection
+				// watchdog are off unless a test turns them on.
+				HeartbeatInterval: -1,
+			},
+			DatabasePath: filepath.Join(tb.TempDir(), "sqlite.db"),
+			Clock:        mockClock,
+		},
+		tb: tb,
+	}
+}
+
+// Config returns a config for creating a connection to the fake server.
+func (h *Harness) Config() hal.Config {
+	return h.config
+}
+
+// Start starts the connection and waits for the initial state sync. The
+// connection is closed when the test finishes. Start can be called again with
+// a new connection (sharing the same config) to simulate a restart.
+func (h *Harness) Start(connection *hal.Connection) {
+	h.tb.Helper()
+
+	h.connection = connection
+	h.eventsBefore = h.Server.EventsSent()
+
+	if err := connection.Start(); err != nil {
+		h.tb.Fatalf("failed to start connection: %v", err)
+	}
+
+	h.tb.Cleanup(connection.Close)
+
+	h.Settle()
+}
+
+// StartConnection creates a connection from the harness config, finds the
+// entities in the entities struct, registers the automations and starts it.
+func (h *Harness) StartConnection(entities any, automations ...hal.Automation) *hal.Connection {
+	h.tb.Helper()
+
+	connection := hal.NewConnection(h.Config())
+	connection.FindEntities(entities)
+	connection.RegisterAutomations(automations...)
+	h.Start(connection)
+
+	return connection
+}
+
+// Seed sets entity states on the fake server without emitting any events.
+// Call before Start to set the initial state of the house.
+func (h *Harness) Seed(states ...homeassistant.State) {
+	h.Server.SeedStates(states...)
+}
+
+// SeedFixture seeds entity states from a YAML or JSON fixture.
+func (h *Harness) SeedFixture(path string) {
+	h.tb.Helper()
+
+	if err := h.Server.LoadFixture(path); err != nil {
+		h.tb.Fatalf("failed to load fixture %s: %v", path, err)
+	}
+}
+
+// SetState changes the state of an entity (e.g. "binary_sensor.x" to "on") as
+// if reported by a device, and waits for automations to finish running.
+func (h *Harness) SetState(entityID, state string, attributes ...map[string]any) {
+	h.tb.Helper()
+
+	merged := map[string]any{}
+	for _, attribute := range attributes {
+		for k, v := range attribute {
+			merged[k] = v
+		}
+	}
+
+	h.Server.SetState(entityID, state, merged)
+	h.Settle()
+}
+
+// SetStateAsUser changes the state of an entity as if changed by a Home
+// Assistant user (e.g. from the app), and waits for automations to finish
+// running.
+func (h *Harness) SetStateAsUser(userID, entityID, state string, attributes ...map[string]any) {
+	h.tb.Helper()
+
+	merged := map[string]any{}
+	for _, attribute := range attributes {
+		for k, v := range attribute {
+			merged[k] = v
+		}
+	}
+
+	h.Server.SetStateAsUser(userID, entityID, state, merged)
+	h.Settle()
+}
+
+// FireEvent fires an event entity (e.g. a button press) and waits for
+// automations to finish running.
+func (h *Harness) FireEvent(entityID, eventType string) {
+	h.tb.Helper()
+
+	h.Server.FireEvent(entityID, eventType, nil)
+	h.Settle()
+}
+
+// Advance moves the mock clock forward, firing any timers that are due, and
+// waits for automations to finish running.
+func (h *Harness) Advance(duration time.Duration) {
+	h.tb.Helper()
+
+	h.Clock.Add(duration)
+	h.Settle()
+}
+
+// Reconnect drops the connection to the fake server, as if the network or
+// Home Assistant went away, and waits for the connection to reconnect and
+// reconcile its automations.
+func (h *Harness) Reconnect() {
+	h.tb.Helper()
+
+	reconnects := h.connection.Reconnects()
+
+	if err := h.Server.Disconnect(); err != nil {
+		h.tb.Fatalf("failed to disconnect: %v", err)
+	}
+
+	deadline := time.Now().Add(reconnectTimeout)
+
+	for h.connection.Reconnects() == reconnects {
+		if time.Now().After(deadline) {
+			h.tb.Fatal("timed out waiting for the connection to reconnect")
+		}
+
+		time.Sleep(settleInterval)
+	}
+
+	h.Settle()
+}
+
+// Settle waits until every event sent by the fake server has been processed
+// by the connection, all automations have finished running and no new events
+// have arrived for a short while.
+func (h *Harness) Settle() {
+	h.tb.Helper()
+
+	if h.connection == nil {
+		return
+	}
+
+	deadline := time.Now().Add(settleTimeout)
+	stableFor := 0
+
+	for stableFor < 3 {
+		if time.Now().After(deadline) {
+			h.tb.Fatalf("timed out waiting for events to be processed: sent=%d processed=%d pending=%d",
+				h.Server.EventsSent()-h.eventsBefore, h.connection.EventsProcessed(), h.connection.PendingAutomations())
+		}
+
+		time.Sleep(settleInterval)
+
+		if uint64(h.Server.EventsSent()-h.eventsBefore) == h.connection.EventsProcessed() &&
+			h.connection.PendingAutomations() == 0 {
+			stableFor++
+		} else {
+			stableFor = 0
+		}
+	}
+}
+
+// ServiceCalls returns all service calls made since the last reset.
+func (h *Harness) ServiceCalls() []hassws.ServiceCall {
+	return h.Server.ServiceCalls()
+}
+
+// ResetServiceCalls clears the recorded service calls.
+func (h *Harness) ResetServiceCalls() {
+	h.Server.ResetServiceCalls()
+}
+
+// Called returns true if the service (e.g. "light.turn_on") was called for the
+// entity since the last reset.
+func (h *Harness) Called(service, entityID string) bool {
+	for _, call := range h.ServiceCalls() {
+		if call.Domain+"."+call.Service == service && slices.Contains(call.EntityIDs, entityID) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AssertCalled fails the test if the service was not called for the entity.
+func (h *Harness) AssertCalled(service, entityID string) {
+	h.tb.Helper()
+
+	if !h.Called(service, entityID) {
+		h.tb.Errorf("expected %s to be called for %s, got calls: %+v", service, entityID, h.ServiceCalls())
+	}
+}
+
+// AssertNotCalled fails the test if the service was called for the entity.
+func (h *Harness) AssertNotCalled(service, entityID string) {
+	h.tb.Helper()
+
+	if h.Called(service, entityID) {
+		h.tb.Errorf("expected %s not to be called for %s, got calls: %+v", service, entityID, h.ServiceCalls())
+	}
+}
+
+// AssertState fails the test if the entity is not in the expected state on
+// the fake server.
+func (h *Harness) AssertState(entityID, expected string) {
+	h.tb.Helper()
+
+	state, ok := h.Server.State(entityID)
+	if !ok {
+		h.tb.Errorf("expected %s to be %q, but it does not exist", entityID, expected)
+
+		return
+	}
+
+	if state.State != expected {
+		h.tb.Errorf("expected %s to be %q, got %q", entityID, expected, state.State)
+	}
+}
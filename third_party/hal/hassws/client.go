@@ -0,0 +1,928 @@
+package hassws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/dansimau/hal/homeassistant"
+	"github.com/dansimau/hal/logger"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	writeTimeoutSeconds = 10
+	closeTimeoutSeconds = 1
+
+	defaultHeartbeatInterval = 30 * time.Second
+	defaultRequestTimeout    = 3 * time.Second
+	defaultSendQueueSize     = 64
+
+	// Number of messages that can be waiting for a response listener (e.g.
+	// events for a subscription) before reading from the websocket is held
+	// up.
+	responseBufferSize = 256
+
+	defaultReconnectMinBackoff = 1 * time.Second
+	defaultReconnectMaxBackoff = 1 * time.Minute
+)
+
+var (
+	ErrAuthInvalid        = errors.New("invalid access token")
+	ErrDisconnected       = errors.New("disconnected from home assistant")
+	ErrReadTimeout        = errors.New("read timeout")
+	ErrUnexpectedResponse = errors.New("unexpected response")
+)
+
+type Client struct {
+	cfg  ClientConfig
+	conn *websocket.Conn
+
+	// disconnected is closed when the current connection is lost, which
+	// releases any callers waiting for a response. It is replaced on every
+	// successful (re)connect.
+	disconnected chan struct{}
+
+	// gorilla/websocket supports only one concurrent writer, so all outbound
+	// messages are queued here and written by a single writer goroutine.
+	outbox    chan outboundMessage
+	connMutex sync.RWMutex
+	closed    atomic.Bool
+
+	// closing is closed by Close, which interrupts any reconnect backoff.
+	closing chan struct{}
+
+	// lastReceived is the time (in unix nanoseconds) that any message was last
+	// received from Home Assistant.
+	lastReceived atomic.Int64
+
+	msgID atomic.Int64
+
+	// Each request has a unique ID and any response will have the same ID. To
+	// provide a synchronous API, we store a listener for each request and
+	// stream the response there.
+	responses map[int]*responseListener
+	mutex     sync.RWMutex
+
+	// Subscriptions are remembered so they can be re-issued after a reconnect.
+	subscriptions      []*subscription
+	disconnectHandlers []func()
+	reconnectHandlers  []func()
+	subscriptionsMutex sync.Mutex
+}
+
+type ClientConfig struct {
+	Host  string
+	Token string
+
+	// ReconnectMinBackoff and ReconnectMaxBackoff bound the exponential
+	// backoff between reconnection attempts.
+	ReconnectMinBackoff time.Duration
+	ReconnectMaxBackoff time.Duration
+
+	// SendQueueSize is the number of outbound messages that can be queued
+	// before senders block.
+	SendQueueSize int
+
+	// HeartbeatInterval is how often a ping is sent to Home Assistant. Zero
+	// uses the default and a negative value disables the heartbeat.
+	HeartbeatInterval time.Duration
+
+	// RequestTimeout is how long to wait for a response to a request when the
+	// caller's context has no deadline.
+	RequestTimeout time.Duration
+
+	// Clock is used for the heartbeat and to record when messages were last
+	// received. Defaults to the real clock.
+	Clock clock.Clock
+}
+
+// outboundMessage is a message waiting to be written to the websocket. The
+// result of the write is sent to done.
+type outboundMessage struct {
+	messageType int
+	data        []byte
+	done        chan error
+}
+
+// responseListener receives the responses to a sent message, in the order
+// they were read from the websocket. done is closed when the listener is
+// removed, which releases the read loop if it is waiting on a full buffer.
+type responseListener struct {
+	ch   chan []byte
+	done chan struct{}
+}
+
+// subscription is an event subscription along with the ID of the message that
+// created it on the current connection.
+type subscription struct {
+	eventType string
+	handler   func(EventMessage)
+	msgID     int
+}
+
+func NewClient(config ClientConfig) *Client {
+	if config.ReconnectMinBackoff <= 0 {
+		config.ReconnectMinBackoff = defaultReconnectMinBackoff
+	}
+
+	if config.ReconnectMaxBackoff < config.ReconnectMinBackoff {
+		config.ReconnectMaxBackoff = max(defaultReconnectMaxBackoff, config.ReconnectMinBackoff)
+	}
+
+	if config.SendQueueSize <= 0 {
+		config.SendQueueSize = defaultSendQueueSize
+	}
+
+	if config.HeartbeatInterval == 0 {
+		config.HeartbeatInterval = defaultHeartbeatInterval
+	}
+
+	if config.RequestTimeout <= 0 {
+		config.RequestTimeout = defaultRequestTimeout
+	}
+
+	if config.Clock == nil {
+		config.Clock = clock.New()
+	}
+
+	disconnected := make(chan struct{})
+	close(disconnected)
+
+	return &Client{
+		cfg:          config,
+		disconnected: disconnected,
+		closing:      make(chan struct{}),
+		responses:    make(map[int]*responseListener),
+	}
+}
+
+func (c *Client) authenticate(conn *websocket.Conn) error {
+	// Read auth_required message from server
+	var authRequired AuthChallenge
+	if err := read(conn, &authRequired); err != nil {
+		return err
+	}
+
+	logger.Debug("Authenticating", "")
+
+	// Send auth message with access token
+	if err := write(conn, AuthRequest{
+		Type:        "auth",
+		AccessToken: c.cfg.Token,
+	}); err != nil {
+		return err
+	}
+
+	// Read auth_ok or auth_invalid response
+	var authResponse AuthResponse
+	if err := read(conn, &authResponse); err != nil {
+		return err
+	}
+
+	logger.Debug("Received auth response", "", "msg", authResponse)
+
+	if authResponse.Type == "auth_invalid" {
+		return fmt.Errorf("%w: %s", ErrAuthInvalid, authResponse.Message)
+	}
+
+	if authResponse.Type != "auth_ok" {
+		return fmt.Errorf("%w: %s", ErrUnexpectedResponse, authResponse.Message)
+	}
+
+	logger.Debug("Authenticated", "")
+
+	return nil
+}
+
+// Close closes the connection cleanly, waiting briefly for Home Assistant to
+// acknowledge the close before dropping the connection. The client does not
+// reconnect after it is closed.
+func (c *Client) Close() error {
+	if c.closed.CompareAndSwap(false, true) {
+		close(c.closing)
+	}
+
+	_, disconnected := c.connection()
+
+	err := c.enqueue(context.Background(), websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "bye"))
+	if errors.Is(err, ErrDisconnected) {
+		return nil
+	}
+
+	select {
+	case <-disconnected:
+	case <-time.After(closeTimeoutSeconds * time.Second):
+		logger.Warn("Timed out waiting for close acknowledgement", "")
+
+		c.connMutex.RLock()
+		conn := c.conn
+		c.connMutex.RUnlock()
+
+		return errors.Join(err, conn.Close())
+	}
+
+	return err
+}
+
+func (c *Client) shutdown(conn *websocket.Conn) error {
+	return conn.Close()
+}
+
+func (c *Client) Connect() error {
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+
+	// Start listening for messages
+	go c.listen(conn)
+
+	return nil
+}
+
+// OnDisconnect registers a function that is called each time the connection
+// is lost unexpectedly, before reconnecting.
+func (c *Client) OnDisconnect(fn func()) {
+	c.subscriptionsMutex.Lock()
+	defer c.subscriptionsMutex.Unlock()
+
+	c.disconnectHandlers = append(c.disconnectHandlers, fn)
+}
+
+// OnReconnect registers a function that is called each time the connection is
+// re-established and all subscriptions have been re-issued.
+func (c *Client) OnReconnect(fn func()) {
+	c.subscriptionsMutex.Lock()
+	defer c.subscriptionsMutex.Unlock()
+
+	c.reconnectHandlers = append(c.reconnectHandlers, fn)
+}
+
+// dial opens and authenticates a new websocket connection and makes it the
+// current connection.
+func (c *Client) dial() (*websocket.Conn, error) {
+	logger.Info("Connecting", "", "host", c.cfg.Host)
+
+	conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://%s/api/websocket", c.cfg.Host), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Debug("Connection established", "")
+
+	if err := c.authenticate(conn); err != nil {
+		conn.Close()
+
+		return nil, err
+	}
+
+	outbox := make(chan outboundMessage, c.cfg.SendQueueSize)
+	disconnected := make(chan struct{})
+
+	c.connMutex.Lock()
+	c.conn = conn
+	c.outbox = outbox
+	c.disconnected = disconnected
+	c.connMutex.Unlock()
+
+	c.lastReceived.Store(c.cfg.Clock.Now().UnixNano())
+
+	go c.writer(conn, outbox, disconnected)
+
+	if c.cfg.HeartbeatInterval > 0 {
+		go c.heartbeat(disconnected)
+	}
+
+	return conn, nil
+}
+
+// LastMessageReceived returns the time that any message (including pongs) was
+// last received from Home Assistant.
+func (c *Client) LastMessageReceived() time.Time {
+	return time.Unix(0, c.lastReceived.Load())
+}
+
+// Reconnect drops the current connection, causing the client to reconnect.
+// This can be used to recover from a connection that is half-open.
+func (c *Client) Reconnect() {
+	c.connMutex.RLock()
+	conn := c.conn
+	c.connMutex.RUnlock()
+
+	if conn == nil {
+		return
+	}
+
+	logger.Warn("Forcing reconnect", "")
+
+	if err := conn.Close(); err != nil {
+		logger.Debug("Error closing connection", "", "error", err)
+	}
+}
+
+// heartbeat periodically pings Home Assistant until the connection is lost.
+func (c *Client) heartbeat(disconnected chan struct{}) {
+	ticker := c.cfg.Clock.Ticker(c.cfg.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.Ping(); err != nil {
+				logger.Warn("Heartbeat failed", "", "error", err)
+			}
+		case <-disconnected:
+			return
+		}
+	}
+}
+
+// connection returns the outbound queue of the current connection and a
+// channel that is closed when it is lost.
+func (c *Client) connection() (chan outboundMessage, chan struct{}) {
+	c.connMutex.RLock()
+	defer c.connMutex.RUnlock()
+
+	return c.outbox, c.disconnected
+}
+
+// writer is the only goroutine that writes to a connection. It exits when the
+// connection is lost.
+func (c *Client) writer(conn *websocket.Conn, outbox chan outboundMessage, disconnected chan struct{}) {
+	for {
+		select {
+		case msg := <-outbox:
+			if err := conn.SetWriteDeadline(time.Now().Add(writeTimeoutSeconds * time.Second)); err != nil {
+				msg.done <- err
+
+				continue
+			}
+
+			msg.done <- conn.WriteMessage(msg.messageType, msg.data)
+		case <-disconnected:
+			return
+		}
+	}
+}
+
+// enqueue queues a message for the writer goroutine and waits until it has
+// been written. It blocks while the queue is full.
+func (c *Client) enqueue(ctx context.Context, messageType int, data []byte) error {
+	outbox, disconnected := c.connection()
+
+	select {
+	case <-disconnected:
+		return ErrDisconnected
+	default:
+	}
+
+	msg := outboundMessage{
+		messageType: messageType,
+		data:        data,
+		done:        make(chan error, 1),
+	}
+
+	select {
+	case outbox <- msg:
+	case <-disconnected:
+		return ErrDisconnected
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case err := <-msg.done:
+		return err
+	case <-disconnected:
+		return ErrDisconnected
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// handleDisconnect releases everyone waiting on the lost connection and
+// reconnects with exponential backoff, unless the client was closed.
+func (c *Client) handleDisconnect(conn *websocket.Conn, cause error) {
+	c.markDisconnected(conn)
+
+	c.closeSubscriptionListeners()
+
+	if err := c.shutdown(conn); err != nil {
+		logger.Debug("Error closing lost connection", "", "error", err)
+	}
+
+	if c.closed.Load() {
+		return
+	}
+
+	logger.Error("Lost connection to Home Assistant", "", "error", cause)
+
+	c.subscriptionsMutex.Lock()
+	disconnectHandlers := append([]func(){}, c.disconnectHandlers...)
+	c.subscriptionsMutex.Unlock()
+
+	for _, handler := range disconnectHandlers {
+		handler()
+	}
+
+	backoff := c.cfg.ReconnectMinBackoff
+
+	for {
+		logger.Info("Reconnecting", "", "backoff", backoff.String())
+
+		if !c.waitBackoff(backoff) {
+			return
+		}
+
+		newConn, err := c.dial()
+		if err != nil {
+			logger.Error("Reconnect failed", "", "error", err)
+
+			backoff = min(backoff*2, c.cfg.ReconnectMaxBackoff)
+
+			continue
+		}
+
+		// The client may have been closed while dialling
+		if c.closed.Load() {
+			c.markDisconnected(newConn)
+
+			if err := c.shutdown(newConn); err != nil {
+				logger.Debug("Error closing new connection", "", "error", err)
+			}
+
+			return
+		}
+
+		go c.listen(newConn)
+
+		c.resubscribe()
+
+		c.subscriptionsMutex.Lock()
+		handlers := append([]func(){}, c.reconnectHandlers...)
+		c.subscriptionsMutex.Unlock()
+
+		for _, handler := range handlers {
+			handler()
+		}
+
+		logger.Info("Reconnected", "")
+
+		return
+	}
+}
+
+// waitBackoff waits before the next reconnection attempt. It returns false if
+// the client was closed in the meantime.
+func (c *Client) waitBackoff(backoff time.Duration) bool {
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return !c.closed.Load()
+	case <-c.closing:
+		return false
+	}
+}
+
+// markDisconnected releases everyone waiting on the connection, if it is still
+// the current connection.
+func (c *Client) markDisconnected(conn *websocket.Conn) {
+	c.connMutex.Lock()
+	defer c.connMutex.Unlock()
+
+	if c.conn != conn {
+		return
+	}
+
+	select {
+	case <-c.disconnected:
+	default:
+		close(c.disconnected)
+	}
+}
+
+// Listen for messages from the websocket and dispatch to listener channels.
+func (c *Client) listen(conn *websocket.Conn) {
+	logger.Info("Connection established", "")
+
+	for {
+		_, msgBytes, err := conn.ReadMessage()
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) && c.closed.Load() {
+				log.Println("Received close message, bye")
+
+				c.markDisconnected(conn)
+
+				if err := c.shutdown(conn); err != nil {
+					logger.Error("Error during shutdown", "", "error", err)
+				}
+
+				return
+			}
+
+			c.handleDisconnect(conn, fmt.Errorf("error reading from websocket: %w", err))
+
+			return
+		}
+
+		c.lastReceived.Store(c.cfg.Clock.Now().UnixNano())
+
+		logger.Debug("Received message", "", "msg", string(msgBytes))
+
+		// Get message ID
+		var msg CommandMessage
+		if err := json.Unmarshal(msgBytes, &msg); err != nil {
+			logger.Error("Error unmarshalling message", "", "error", err)
+
+			continue
+		}
+
+		c.mutex.RLock()
+		listener, ok := c.responses[msg.ID]
+		c.mutex.RUnlock()
+
+		if !ok {
+			logger.Warn("No listeners for message", "", "id", msg.ID)
+
+			continue
+		}
+
+		// Deliver from the read loop so that messages, e.g. two state changes
+		// of the same entity, reach the listener in the order they were sent.
+		// A listener that falls behind holds up reading until it catches up.
+		select {
+		case listener.ch <- msgBytes:
+		case <-listener.done:
+		}
+	}
+}
+
+// Generate a unique ID for each message.
+func (c *Client) nextMsgID() int {
+	return int(c.msgID.Add(1))
+}
+
+// Read a message from the websocket and unmarshal it into the target.
+func read(conn *websocket.Conn, target any) error {
+	_, msgBytes, err := conn.ReadMessage()
+	if err != nil {
+		return err
+	}
+
+	logger.Debug("Received message", "", "msg", string(msgBytes))
+
+	return json.Unmarshal(msgBytes, target)
+}
+
+// Write a message directly to the websocket. This is only safe before the
+// writer goroutine for the connection has been started.
+func write(conn *websocket.Conn, msg any) error {
+	msgBytes, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	logger.Debug("Writing message", "", "msg", string(msgBytes))
+
+	return conn.WriteMessage(websocket.TextMessage, msgBytes)
+}
+
+// Send a message to the websocket on the current connection.
+func (c *Client) send(ctx context.Context, msg any) error {
+	msgBytes, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	logger.Debug("Writing message", "", "msg", string(msgBytes))
+
+	return c.enqueue(ctx, websocket.TextMessage, msgBytes)
+}
+
+// Add a listener for responses to a specific sent message.
+func (c *Client) addMessageResponseListener(msgID int) *responseListener {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	listener := &responseListener{
+		ch:   make(chan []byte, responseBufferSize),
+		done: make(chan struct{}),
+	}
+	c.responses[msgID] = listener
+
+	return listener
+}
+
+// closeMessageResponseListener removes the listener for a sent message and
+// closes it, unless that has already been done.
+func (c *Client) closeMessageResponseListener(msgID int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if listener, ok := c.responses[msgID]; ok {
+		delete(c.responses, msgID)
+		close(listener.done)
+	}
+}
+
+// Send a message to the websocket and return the ID of the message and a
+// listener for its responses.
+func (c *Client) sendMessageStreamResponses(ctx context.Context, msgBytes []byte) (msgID int, listener *responseListener, err error) {
+	var msg jsonMessage
+	if err := json.Unmarshal(msgBytes, &msg); err != nil {
+		return 0, nil, err
+	}
+
+	msgID = c.nextMsgID()
+	msg["id"] = msgID
+
+	listener = c.addMessageResponseListener(msgID)
+
+	if err := c.send(ctx, msg); err != nil {
+		c.closeMessageResponseListener(msgID)
+
+		return 0, nil, err
+	}
+
+	return msgID, listener, nil
+}
+
+// Send a message to the websocket and wait for a response.
+func (c *Client) sendMessageWaitResponse(ctx context.Context, msgBytes []byte) (response []byte, err error) {
+	msgID, listener, err := c.sendMessageStreamResponses(ctx, msgBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	// Stop listening after the first response, or once we give up waiting
+	defer c.closeMessageResponseListener(msgID)
+
+	return c.readMesssageFromChannel(ctx, listener.ch)
+}
+
+// Read a message from a listener channel. If the context has no deadline, the
+// configured request timeout applies.
+func (c *Client) readMesssageFromChannel(ctx context.Context, ch chan []byte) (response []byte, err error) {
+	_, disconnected := c.connection()
+
+	var timeout <-chan time.Time
+
+	if _, ok := ctx.Deadline(); !ok {
+		timer := time.NewTimer(c.cfg.RequestTimeout)
+		defer timer.Stop()
+
+		timeout = timer.C
+	}
+
+	select {
+	case res := <-ch:
+		return res, nil
+	case <-disconnected:
+		return nil, ErrDisconnected
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-timeout:
+		return nil, ErrReadTimeout
+	}
+}
+
+// Subscribe to home assistant events. The subscription is automatically
+// re-issued if the connection is lost and re-established.
+func (c *Client) SubscribeEvents(eventType string, handler func(EventMessage)) error {
+	sub := &subscription{
+		eventType: eventType,
+		handler:   handler,
+	}
+
+	if err := c.subscribe(sub); err != nil {
+		return err
+	}
+
+	c.subscriptionsMutex.Lock()
+	c.subscriptions = append(c.subscriptions, sub)
+	c.subscriptionsMutex.Unlock()
+
+	return nil
+}
+
+// resubscribe re-issues all subscriptions on the current connection.
+func (c *Client) resubscribe() {
+	c.subscriptionsMutex.Lock()
+	subscriptions := append([]*subscription{}, c.subscriptions...)
+	c.subscriptionsMutex.Unlock()
+
+	for _, sub := range subscriptions {
+		if err := c.subscribe(sub); err != nil {
+			logger.Error("Error resubscribing to events", "", "event_type", sub.eventType, "error", err)
+		}
+	}
+}
+
+// closeSubscriptionListeners closes the listeners of all subscriptions on a
+// lost connection, which stops their dispatch goroutines.
+func (c *Client) closeSubscriptionListeners() {
+	c.subscriptionsMutex.Lock()
+	defer c.subscriptionsMutex.Unlock()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, sub := range c.subscriptions {
+		if listener, ok := c.responses[sub.msgID]; ok {
+			delete(c.responses, sub.msgID)
+			close(listener.done)
+		}
+	}
+}
+
+// subscribe issues a subscription on the current connection and starts
+// dispatching events to its handler.
+func (c *Client) subscribe(sub *subscription) error {
+	msg := subscribeEventsRequest{
+		ID:        c.nextMsgID(),
+		Type:      MessageTypeSubscribeEvents,
+		EventType: sub.eventType,
+	}
+
+	reqBytes, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	msgID, listener, err := c.sendMessageStreamResponses(context.Background(), reqBytes)
+	if err != nil {
+		return err
+	}
+
+	// First message contains the initial response about the subscription
+	resBytes, err := c.readMesssageFromChannel(context.Background(), listener.ch)
+	if err != nil {
+		c.closeMessageResponseListener(msgID)
+
+		return err
+	}
+
+	var res subscribeEventsResponse
+	if err := json.Unmarshal(resBytes, &res); err != nil {
+		c.closeMessageResponseListener(msgID)
+
+		return err
+	}
+
+	if !res.Success {
+		c.closeMessageResponseListener(msgID)
+
+		return fmt.Errorf("%w: %s", ErrUnexpectedResponse, resBytes)
+	}
+
+	c.subscriptionsMutex.Lock()
+	sub.msgID = res.ID
+	c.subscriptionsMutex.Unlock()
+
+	handler := sub.handler
+
+	dispatch := func(b []byte) {
+		var msg EventMessage
+		if err := json.Unmarshal(b, &msg); err != nil {
+			logger.Error("Error unmarshalling event message", "", "error", err)
+
+			return
+		}
+
+		handler(msg)
+	}
+
+	// Create Goroutine to event messages and dispatch to handler
+	go func(listener *responseListener) {
+		for {
+			select {
+			case b := <-listener.ch:
+				dispatch(b)
+			case <-listener.done:
+				// Deliver the events that were read before the listener was
+				// closed
+				for {
+					select {
+					case b := <-listener.ch:
+						dispatch(b)
+					default:
+						return
+					}
+				}
+			}
+		}
+	}(listener)
+
+	logger.Info("Listening for state changes", "")
+
+	return nil
+}
+
+func (c *Client) CallService(msg CallServiceRequest) (CallServiceResponse, error) {
+	return c.CallServiceContext(context.Background(), msg)
+}
+
+// CallServiceContext calls a service and waits for the result. If Home
+// Assistant reports that the call failed, the returned error is a
+// *ResultError.
+func (c *Client) CallServiceContext(ctx context.Context, msg CallServiceRequest) (CallServiceResponse, error) {
+	reqBytes, err := json.Marshal(msg)
+	if err != nil {
+		return CallServiceResponse{}, err
+	}
+
+	resBytes, err := c.sendMessageWaitResponse(ctx, reqBytes)
+	if err != nil {
+		return CallServiceResponse{}, err
+	}
+
+	var resp CallServiceResponse
+	if err := json.Unmarshal(resBytes, &resp); err != nil {
+		return CallServiceResponse{}, err
+	}
+
+	if resp.Type == MessageTypeResult && !resp.Success {
+		logger.Error("Call service failed", "", "err", resp.Error)
+
+		if resp.Error == nil {
+			return resp, fmt.Errorf("%w: %s", ErrUnexpectedResponse, resBytes)
+		}
+
+		return resp, resp.Error
+	}
+
+	return resp, nil
+}
+
+// Ping sends a ping to Home Assistant and waits for the pong.
+func (c *Client) Ping() error {
+	reqBytes, err := json.Marshal(CommandMessage{
+		Type: MessageTypePing,
+	})
+	if err != nil {
+		return err
+	}
+
+	resBytes, err := c.sendMessageWaitResponse(context.Background(), reqBytes)
+	if err != nil {
+		return err
+	}
+
+	var resp CommandMessage
+	if err := json.Unmarshal(resBytes, &resp); err != nil {
+		return err
+	}
+
+	if resp.Type != MessageTypePong {
+		return fmt.Errorf("%w: %s", ErrUnexpectedResponse, resBytes)
+	}
+
+	return nil
+}
+
+func (c *Client) GetStates() ([]homeassistant.State, error) {
+	msg := CommandMessage{
+		ID:   c.nextMsgID(),
+		Type: MessageTypeGetStates,
+	}
+
+	reqBytes, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	resBytes, err := c.sendMessageWaitResponse(context.Background(), reqBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp CommandResponse
+	if err := json.Unmarshal(resBytes, &resp); err != nil {
+		return nil, err
+	}
+
+	if !resp.Success {
+		var resultErr ResultError
+		if err := json.Unmarshal(resp.Error, &resultErr); err == nil && resultErr.Code != "" {
+			return nil, &resultErr
+		}
+
+		return nil, fmt.Errorf("%w: %s", ErrUnexpectedResponse, resp.Error)
+	}
+
+	var states []homeassistant.State
+	if err := json.Unmarshal(resp.Result, &states); err != nil {
+		return nil, err
+	}
+
+	return states, nil
+}
@@ -0,0 +1,370 @@
+package hassws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const testToken = "test-token"
+
+func newTestClient(t *testing.T, config ClientConfig) (*Client, *Server) {
+	t.Helper()
+
+	server, err := NewServer(map[string]string{testToken: "test-user"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		_ = server.Shutdown()
+	})
+
+	config.Host = server.ListenAddress()
+	config.Token = testToken
+	config.HeartbeatInterval = -1
+
+	client := NewClient(config)
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	return client, server
+}
+
+// newQueuedClient returns a client whose outbound queue is drained by the test
+// instead of a writer goroutine.
+func newQueuedClient(size int) (*Client, chan outboundMessage, chan struct{}) {
+	client := NewClient(ClientConfig{SendQueueSize: size})
+
+	outbox := make(chan outboundMessage, size)
+	disconnected := make(chan struct{})
+
+	client.outbox = outbox
+	client.disconnected = disconnected
+
+	return client, outbox, disconnected
+}
+
+func (c *Client) pendingResponses() int {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return len(c.responses)
+}
+
+func (c *Client) currentConn() any {
+	c.connMutex.RLock()
+	defer c.connMutex.RUnlock()
+
+	return c.conn
+}
+
+func TestClientRemovesResponseListenerAfterTimeout(t *testing.T) {
+	client, server := newTestClient(t, ClientConfig{RequestTimeout: 50 * time.Millisecond})
+	defer client.Close()
+
+	server.SetLatency(200 * time.Millisecond)
+
+	_, err := client.CallService(CallServiceRequest{
+		Type:    MessageTypeCallService,
+		Domain:  "light",
+		Service: "turn_on",
+	})
+	if !errors.Is(err, ErrReadTimeout) {
+		t.Fatalf("expected %v, got %v", ErrReadTimeout, err)
+	}
+
+	if n := client.pendingResponses(); n != 0 {
+		t.Errorf("expected no response listeners, got %d", n)
+	}
+}
+
+func TestClientRemovesResponseListenerAfterResponse(t *testing.T) {
+	client, _ := newTestClient(t, ClientConfig{})
+	defer client.Close()
+
+	if err := client.Ping(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := client.pendingResponses(); n != 0 {
+		t.Errorf("expected no response listeners, got %d", n)
+	}
+}
+
+func TestClientReturnsResultErrorForFailedCall(t *testing.T) {
+	client, server := newTestClient(t, ClientConfig{})
+	defer client.Close()
+
+	server.SetServiceError("light.turn_on", &ResultError{Code: "invalid_format", Message: "bad brightness"})
+
+	_, err := client.CallService(CallServiceRequest{
+		Type:    MessageTypeCallService,
+		Domain:  "light",
+		Service: "turn_on",
+	})
+
+	var resultErr *ResultError
+	if !errors.As(err, &resultErr) {
+		t.Fatalf("expected a *ResultError, got %T: %v", err, err)
+	}
+
+	if resultErr.Code != "invalid_format" || resultErr.Message != "bad brightness" {
+		t.Errorf("expected the error from Home Assistant, got %+v", resultErr)
+	}
+}
+
+func TestClientReturnsPromptlyWhenContextIsCancelled(t *testing.T) {
+	client, server := newTestClient(t, ClientConfig{RequestTimeout: time.Minute})
+	defer client.Close()
+
+	server.SetLatency(time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+
+	_, err := client.CallServiceContext(ctx, CallServiceRequest{
+		Type:    MessageTypeCallService,
+		Domain:  "light",
+		Service: "turn_on",
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("expected the call to return once cancelled, took %s", elapsed)
+	}
+
+	if n := client.pendingResponses(); n != 0 {
+		t.Errorf("expected no response listeners, got %d", n)
+	}
+}
+
+func TestClientCloseInterruptsReconnectBackoff(t *testing.T) {
+	client, server := newTestClient(t, ClientConfig{
+		ReconnectMinBackoff: time.Minute,
+		ReconnectMaxBackoff: time.Minute,
+	})
+
+	conn := client.currentConn()
+
+	if err := server.Disconnect(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for the client to notice and start backing off
+	_, disconnected := client.connection()
+	select {
+	case <-disconnected:
+	case <-time.After(time.Second):
+		t.Fatal("client did not notice the disconnect")
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		client.Close()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Close blocked")
+	}
+
+	if client.waitBackoff(time.Minute) {
+		t.Error("expected backoff to be interrupted after Close")
+	}
+
+	if client.currentConn() != conn {
+		t.Error("expected no reconnect after Close")
+	}
+}
+
+func TestClientDoesNotReconnectIfClosedDuringBackoff(t *testing.T) {
+	client, server := newTestClient(t, ClientConfig{
+		ReconnectMinBackoff: 100 * time.Millisecond,
+		ReconnectMaxBackoff: 100 * time.Millisecond,
+	})
+
+	conn := client.currentConn()
+
+	if err := server.Disconnect(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, disconnected := client.connection()
+	<-disconnected
+
+	client.Close()
+	time.Sleep(300 * time.Millisecond)
+
+	if client.currentConn() != conn {
+		t.Error("expected no reconnect after Close")
+	}
+}
+
+func TestClientDeliversEventsInOrder(t *testing.T) {
+	client, server := newTestClient(t, ClientConfig{})
+	defer client.Close()
+
+	const n = 500
+
+	var (
+		mutex  sync.Mutex
+		states []string
+	)
+
+	received := make(chan struct{})
+
+	if err := client.SubscribeEvents(string(MessageTypeStateChanged), func(msg EventMessage) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		states = append(states, msg.Event.EventData.NewState.State)
+		if len(states) == n {
+			close(received)
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range n {
+		server.SetState("sensor.counter", strconv.Itoa(i), nil)
+	}
+
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for events")
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	for i, state := range states {
+		if state != strconv.Itoa(i) {
+			t.Fatalf("expected event %d to have state %d, got %s", i, i, state)
+		}
+	}
+}
+
+func TestClientSendBlocksWhileQueueIsFull(t *testing.T) {
+	client, outbox, _ := newQueuedClient(1)
+
+	queued := make(chan error, 1)
+
+	go func() {
+		queued <- client.send(context.Background(), CommandMessage{Type: MessageTypePing})
+	}()
+
+	// The first message fills the queue
+	deadline := time.Now().Add(time.Second)
+	for len(outbox) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the message to be queued")
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := client.send(ctx, CommandMessage{Type: MessageTypePing}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected send to block until the context expired, got %v", err)
+	}
+
+	// The queued message is still sent
+	msg := <-outbox
+	msg.done <- nil
+
+	if err := <-queued; err != nil {
+		t.Errorf("expected the queued message to be sent, got %v", err)
+	}
+}
+
+func TestClientSendReturnsResultOfItsOwnWrite(t *testing.T) {
+	client, outbox, _ := newQueuedClient(2)
+
+	writeErr := errors.New("write failed")
+	results := make([]chan error, 2)
+
+	for i := range results {
+		results[i] = make(chan error, 1)
+
+		go func() {
+			results[i] <- client.send(context.Background(), CommandMessage{ID: i, Type: MessageTypePing})
+		}()
+
+		// Fail the write of the first message only
+		msg := <-outbox
+		if i == 0 {
+			msg.done <- writeErr
+		} else {
+			msg.done <- nil
+		}
+	}
+
+	if err := <-results[0]; !errors.Is(err, writeErr) {
+		t.Errorf("expected the first send to fail with %v, got %v", writeErr, err)
+	}
+
+	if err := <-results[1]; err != nil {
+		t.Errorf("expected the second send to succeed, got %v", err)
+	}
+}
+
+func TestClientSendsPingAndCloseThroughWriter(t *testing.T) {
+	client, outbox, disconnected := newQueuedClient(1)
+
+	pinged := make(chan error, 1)
+
+	go func() {
+		pinged <- client.Ping()
+	}()
+
+	msg := <-outbox
+
+	var ping CommandMessage
+	if err := json.Unmarshal(msg.data, &ping); err != nil || msg.messageType != websocket.TextMessage || ping.Type != MessageTypePing {
+		t.Errorf("expected a ping to be queued, got %d %s", msg.messageType, msg.data)
+	}
+
+	msg.done <- nil
+
+	closed := make(chan error, 1)
+
+	go func() {
+		closed <- client.Close()
+	}()
+
+	msg = <-outbox
+	if msg.messageType != websocket.CloseMessage {
+		t.Errorf("expected a close message to be queued, got %d %s", msg.messageType, msg.data)
+	}
+
+	msg.done <- nil
+
+	// Home Assistant acknowledges the close by dropping the connection
+	close(disconnected)
+
+	if err := <-closed; err != nil {
+		t.Errorf("expected a clean close, got %v", err)
+	}
+
+	if err := <-pinged; !errors.Is(err, ErrDisconnected) {
+		t.Errorf("expected the ping to be released by the disconnect, got %v", err)
+	}
+}
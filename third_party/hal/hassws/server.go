@@ -0,0 +1,821 @@
+package hassws
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/dansimau/hal/homeassistant"
+	"github.com/dansimau/hal/logger"
+	"github.com/gorilla/websocket"
+	"gopkg.in/yaml.v3"
+)
+
+const readHeaderTimeoutSeconds = 10
+
+// Server is an in-memory stand-in for the Home Assistant websocket API, for
+// tests and local development. It holds entity states, applies service calls
+// to them and emits state_changed events like the real thing.
+type Server struct {
+	listener  net.Listener
+	http      *http.Server
+	websocket *websocket.Conn
+
+	messagesReceived [][]byte
+	messagesSent     [][]byte
+
+	// Subscribers is a list of message IDs that initiated a subscription on
+	// the current connection.
+	subscribers []int
+
+	// validUsers maps auth tokens to user IDs
+	validUsers map[string]string
+	// authenticatedUserID stores the user ID of the authenticated client
+	authenticatedUserID string
+
+	clock        clock.Clock
+	states       map[string]homeassistant.State
+	serviceCalls []ServiceCall
+
+	// Fault injection
+	latency       time.Duration
+	serviceErrors map[string]*ResultError
+	duringSync    func()
+	ignorePings   bool
+
+	contextID  int
+	eventsSent int
+
+	lock sync.RWMutex
+}
+
+// ServiceCall is a service call received by the server.
+type ServiceCall struct {
+	Domain    string
+	Service   string
+	EntityIDs []string
+	Data      map[string]any
+	ContextID string
+	UserID    string
+}
+
+func NewServer(validUsers map[string]string) (*Server, error) {
+	server := &Server{
+		http: &http.Server{
+			ReadHeaderTimeout: readHeaderTimeoutSeconds * time.Second,
+		},
+		validUsers:    validUsers,
+		clock:         clock.New(),
+		states:        make(map[string]homeassistant.State),
+		serviceErrors: make(map[string]*ResultError),
+	}
+
+	server.http.Handler = http.HandlerFunc(server.handler)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	server.listener = listener
+
+	go func() {
+		if err := server.http.Serve(server.listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			panic(err)
+		}
+	}()
+
+	return server, nil
+}
+
+func (s *Server) handler(w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	defer conn.Close()
+
+	if err := s.handleAuthentication(conn); err != nil {
+		logger.Error("Authentication failed", "", "error", err)
+
+		return
+	}
+
+	// Only one client is served at a time. A new connection (e.g. after a
+	// reconnect) replaces the previous one along with its subscriptions.
+	s.lock.Lock()
+	s.websocket = conn
+	s.subscribers = nil
+	s.lock.Unlock()
+
+	s.listen(conn)
+}
+
+func (s *Server) listen(conn *websocket.Conn) {
+	for {
+		_, messageBytes, err := conn.ReadMessage()
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				// The server keeps listening so that a restarted client can
+				// connect again.
+				log.Println("[Server] Received close message, bye")
+
+				break
+			}
+
+			logger.Error("Failed during read", "", "error", err)
+
+			break
+		}
+
+		log.Printf("[Server] Received message: %s", string(messageBytes))
+
+		s.lock.Lock()
+		s.messagesReceived = append(s.messagesReceived, messageBytes)
+		s.lock.Unlock()
+
+		// Parse as CommandMessage
+		var cmd CommandMessage
+		if err := json.Unmarshal(messageBytes, &cmd); err != nil {
+			logger.Error("[Server] Invalid message", "", "error", err)
+
+			continue
+		}
+
+		switch cmd.Type {
+		case MessageTypeCallService:
+			var callServiceMessage CallServiceRequest
+			if err := json.Unmarshal(messageBytes, &callServiceMessage); err != nil {
+				s.sendError(cmd.ID, "invalid_format", err.Error())
+
+				continue
+			}
+
+			s.handleCallService(cmd.ID, callServiceMessage)
+
+		case MessageTypeSubscribeEvents:
+			s.lock.Lock()
+			s.subscribers = append(s.subscribers, cmd.ID)
+			s.lock.Unlock()
+
+			s.SendMessage(subscribeEventsResponse{
+				ID:      cmd.ID,
+				Type:    MessageTypeResult,
+				Success: true,
+			})
+
+		case MessageTypePing:
+			s.lock.RLock()
+			ignorePings := s.ignorePings
+			s.lock.RUnlock()
+
+			if ignorePings {
+				continue
+			}
+
+			s.SendMessage(CommandMessage{
+				ID:   cmd.ID,
+				Type: MessageTypePong,
+			})
+
+		case MessageTypeGetStates:
+			result, err := json.Marshal(s.States())
+			if err != nil {
+				s.sendError(cmd.ID, "unknown_error", err.Error())
+
+				continue
+			}
+
+			s.lock.RLock()
+			duringSync := s.duringSync
+			s.lock.RUnlock()
+
+			if duringSync != nil {
+				duringSync()
+			}
+
+			s.SendMessage(CommandResponse{
+				ID:      cmd.ID,
+				Type:    MessageTypeResult,
+				Success: true,
+				Result:  result,
+			})
+		default:
+			s.sendError(cmd.ID, "unknown_command", "Unknown command.")
+		}
+	}
+}
+
+// handleCallService applies a service call to the stored entity states and
+// emits state_changed events for every entity whose state or attributes
+// changed.
+func (s *Server) handleCallService(id int, req CallServiceRequest) {
+	s.lock.RLock()
+	latency := s.latency
+	serviceErr := s.serviceErrors[req.Domain+"."+req.Service]
+	s.lock.RUnlock()
+
+	// Latency is in real time, not the server clock, so that it doesn't
+	// need a mock clock to be advanced
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+
+	entityIDs := getEntityIDs(req)
+	attributes := map[string]any{}
+
+	for k, v := range req.Data {
+		if k == "entity_id" {
+			continue
+		}
+
+		attributes[k] = v
+	}
+
+	contextID := s.nextContextID()
+
+	s.lock.Lock()
+	s.serviceCalls = append(s.serviceCalls, ServiceCall{
+		Domain:    req.Domain,
+		Service:   req.Service,
+		EntityIDs: entityIDs,
+		Data:      req.Data,
+		ContextID: contextID,
+		UserID:    s.authenticatedUserID,
+	})
+	s.lock.Unlock()
+
+	if serviceErr != nil {
+		s.sendError(id, serviceErr.Code, serviceErr.Message)
+
+		return
+	}
+
+	if !isSupportedService(req.Domain, req.Service) {
+		s.sendError(id, "not_found", fmt.Sprintf("Service %s.%s not found.", req.Domain, req.Service))
+
+		return
+	}
+
+	resp := CallServiceResponse{
+		ID:      id,
+		Type:    MessageTypeResult,
+		Success: true,
+	}
+	resp.Result.Context.ID = contextID
+
+	s.SendMessage(resp)
+
+	for _, entityID := range entityIDs {
+		s.lock.Lock()
+		oldState, exists := s.states[entityID]
+		newState := applyService(oldState, entityID, req.Service, attributes)
+		s.lock.Unlock()
+
+		// Like Home Assistant, don't emit an event if nothing changed
+		if exists && newState.State == oldState.State &&
+			maps.EqualFunc(newState.Attributes, oldState.Attributes, func(a, b any) bool { return reflect.DeepEqual(a, b) }) {
+			continue
+		}
+
+		var oldStatePtr *homeassistant.State
+		if exists {
+			oldStatePtr = &oldState
+		}
+
+		s.setState(newState, oldStatePtr, homeassistant.EventMessageContext{
+			ID:     contextID,
+			UserID: s.authenticatedUserID,
+		})
+	}
+}
+
+// isSupportedService returns true for services the fake knows how to apply.
+func isSupportedService(domain, service string) bool {
+	switch domain {
+	case "light", "input_boolean":
+		return slices.Contains([]string{"turn_on", "turn_off", "toggle"}, service)
+	case "persistent_notification":
+		return slices.Contains([]string{"create", "dismiss"}, service)
+	case "notify":
+		return true
+	default:
+		return false
+	}
+}
+
+// applyService returns the state of an entity after a turn_on, turn_off or
+// toggle service call. Attributes are merged into the existing attributes.
+func applyService(state homeassistant.State, entityID, service string, attributes map[string]any) homeassistant.State {
+	newState := homeassistant.State{
+		EntityID:    entityID,
+		State:       state.State,
+		Attributes:  map[string]any{},
+		LastChanged: state.LastChanged,
+	}
+
+	for k, v := range state.Attributes {
+		newState.Attributes[k] = v
+	}
+
+	if service == "toggle" {
+		service = "turn_on"
+		if state.State == "on" {
+			service = "turn_off"
+		}
+	}
+
+	switch service {
+	case "turn_on":
+		newState.State = "on"
+
+		for k, v := range attributes {
+			newState.Attributes[k] = v
+		}
+	case "turn_off":
+		newState.State = "off"
+
+		// Home Assistant doesn't report a brightness for lights that are off
+		delete(newState.Attributes, "brightness")
+	}
+
+	return newState
+}
+
+// getEntityIDs returns the entity IDs targeted by a service call.
+func getEntityIDs(req CallServiceRequest) []string {
+	var entityIDs []string
+
+	switch v := req.Data["entity_id"].(type) {
+	case string:
+		entityIDs = append(entityIDs, v)
+	case []any:
+		for _, entityID := range v {
+			if s, ok := entityID.(string); ok {
+				entityIDs = append(entityIDs, s)
+			}
+		}
+	}
+
+	if entityID, ok := req.Target["entity_id"]; ok {
+		entityIDs = append(entityIDs, entityID)
+	}
+
+	return entityIDs
+}
+
+func (s *Server) nextContextID() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.contextID++
+
+	return fmt.Sprintf("%026d", s.contextID)
+}
+
+func (s *Server) sendError(id int, code, message string) {
+	s.SendMessage(CallServiceResponse{
+		ID:      id,
+		Type:    MessageTypeResult,
+		Success: false,
+		Error: &ResultError{
+			Code:    code,
+			Message: message,
+		},
+	})
+}
+
+func (s *Server) handleAuthentication(conn *websocket.Conn) error {
+	// Send auth_required message
+	authChallenge := AuthChallenge{
+		Type:      "auth_required",
+		HAVersion: "2024.1.0",
+	}
+	if err := conn.WriteJSON(authChallenge); err != nil {
+		return err
+	}
+
+	// Wait for auth message
+	var authReq AuthRequest
+	if err := conn.ReadJSON(&authReq); err != nil {
+		return err
+	}
+
+	// Validate token against valid users map
+	userID, valid := s.validUsers[authReq.AccessToken]
+	if !valid {
+		authResp := AuthResponse{
+			Type:      "auth_invalid",
+			Message:   "Invalid access token",
+			HAVersion: "2024.1.0",
+		}
+		if err := conn.WriteJSON(authResp); err != nil {
+			return err
+		}
+
+		return ErrAuthInvalid
+	}
+
+	// Store authenticated user ID
+	s.lock.Lock()
+	s.authenticatedUserID = userID
+	s.lock.Unlock()
+
+	authResp := AuthResponse{
+		Type:      "auth_ok",
+		HAVersion: "2024.1.0",
+	}
+
+	return conn.WriteJSON(authResp)
+}
+
+func (s *Server) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.websocket == nil {
+		return nil
+	}
+
+	return s.websocket.WriteMessage(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, "bye"),
+	)
+}
+
+// Disconnect drops the current client connection without a close handshake,
+// simulating a network failure or Home Assistant restart. The server keeps
+// listening so the client can reconnect.
+func (s *Server) Disconnect() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.websocket == nil {
+		return nil
+	}
+
+	return s.websocket.Close()
+}
+
+// Shutdown drops the current client connection and stops listening.
+func (s *Server) Shutdown() error {
+	var errs []error
+
+	s.lock.RLock()
+	conn := s.websocket
+	s.lock.RUnlock()
+
+	if conn != nil {
+		errs = append(errs, conn.Close())
+	}
+
+	if s.http != nil {
+		errs = append(errs, s.http.Close())
+	}
+
+	if s.listener != nil {
+		errs = append(errs, s.listener.Close())
+	}
+
+	return errors.Join(errs...)
+}
+
+func (s *Server) ListenAddress() string {
+	return s.listener.Addr().String()
+}
+
+func (s *Server) SendMessage(message any) {
+	msgBytes, err := json.Marshal(message)
+	if err != nil {
+		panic(err)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.websocket == nil {
+		return
+	}
+
+	if err := s.websocket.WriteMessage(websocket.TextMessage, msgBytes); err != nil {
+		logger.Error("[Server] Failed to send message", "", "error", err)
+
+		return
+	}
+
+	s.messagesSent = append(s.messagesSent, msgBytes)
+
+	log.Printf("[Server] Sent message: %s", string(msgBytes))
+}
+
+func (s *Server) MessagesReceived() [][]byte {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return slices.Clone(s.messagesReceived)
+}
+
+func (s *Server) MessagesSent() [][]byte {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return slices.Clone(s.messagesSent)
+}
+
+// SendEvent sends a state change event to the server.
+func (s *Server) SendEvent(event homeassistant.Event) {
+	s.lock.Lock()
+	subscribers := slices.Clone(s.subscribers)
+	s.eventsSent += len(subscribers)
+	s.lock.Unlock()
+
+	for _, id := range subscribers {
+		s.SendMessage(EventMessage{
+			ID:    id,
+			Type:  MessageTypeEvent,
+			Event: event,
+		})
+	}
+}
+
+// EventsSent returns the number of event messages sent to subscribers.
+func (s *Server) EventsSent() int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.eventsSent
+}
+
+// SetLatency delays the response to every service call by the specified
+// duration. The delay is in real time, regardless of the server clock, and
+// like a slow Home Assistant it holds up every message that follows.
+func (s *Server) SetLatency(latency time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.latency = latency
+}
+
+// SetClock sets the clock used to timestamp states, e.g. a mock clock shared
+// with the connection under test. Call it before seeding any states.
+func (s *Server) SetClock(clock clock.Clock) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.clock = clock
+}
+
+// SetServiceError makes every call to the specified service (e.g.
+// "light.turn_on") fail with the given error. Pass nil to clear it.
+func (s *Server) SetServiceError(service string, err *ResultError) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err == nil {
+		delete(s.serviceErrors, service)
+
+		return
+	}
+
+	s.serviceErrors[service] = err
+}
+
+// SetIgnorePings stops the server from answering pings, so that the
+// connection looks half-open to a client that relies on its heartbeat.
+func (s *Server) SetIgnorePings(ignore bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.ignorePings = ignore
+}
+
+// SetDuringSync sets a function that is called after the states have been
+// read for a get_states request, but before they are sent. Events it emits
+// reach the client while it is waiting for the states, as if they raced the
+// sync. Pass nil to clear it.
+func (s *Server) SetDuringSync(fn func()) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.duringSync = fn
+}
+
+// ServiceCalls returns all service calls received by the server.
+func (s *Server) ServiceCalls() []ServiceCall {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return slices.Clone(s.serviceCalls)
+}
+
+// ResetServiceCalls clears the recorded service calls.
+func (s *Server) ResetServiceCalls() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.serviceCalls = nil
+}
+
+// LoadFixture seeds entity states from a YAML or JSON file containing a list
+// of states, in the same format as returned by get_states.
+func (s *Server) LoadFixture(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	// YAML is a superset of JSON, so decode as YAML and then round-trip via
+	// JSON to pick up the json tags on homeassistant.State.
+	var fixture any
+	if err := yaml.Unmarshal(b, &fixture); err != nil {
+		return err
+	}
+
+	jsonBytes, err := json.Marshal(fixture)
+	if err != nil {
+		return err
+	}
+
+	var states []homeassistant.State
+	if err := json.Unmarshal(jsonBytes, &states); err != nil {
+		return err
+	}
+
+	s.SeedStates(states...)
+
+	return nil
+}
+
+// SeedStates sets entity states without emitting any events.
+func (s *Server) SeedStates(states ...homeassistant.State) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := s.clock.Now()
+
+	for _, state := range states {
+		if state.LastChanged.IsZero() {
+			state.LastChanged = now
+		}
+
+		if state.LastUpdated.IsZero() {
+			state.LastUpdated = now
+		}
+
+		s.states[state.EntityID] = state
+	}
+}
+
+// States returns the current state of all entities.
+func (s *Server) States() []homeassistant.State {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	states := make([]homeassistant.State, 0, len(s.states))
+	for _, state := range s.states {
+		states = append(states, state)
+	}
+
+	slices.SortFunc(states, func(a, b homeassistant.State) int {
+		if a.EntityID < b.EntityID {
+			return -1
+		}
+
+		if a.EntityID > b.EntityID {
+			return 1
+		}
+
+		return 0
+	})
+
+	return states
+}
+
+// State returns the current state of an entity.
+func (s *Server) State(entityID string) (homeassistant.State, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	state, ok := s.states[entityID]
+
+	return state, ok
+}
+
+// SetState changes the state of an entity as if it was reported by a device
+// (e.g. a binary_sensor detecting motion) and emits a state_changed event.
+// Attributes are merged into the existing attributes.
+func (s *Server) SetState(entityID, state string, attributes map[string]any) {
+	s.SetStateWithContext(entityID, state, attributes, homeassistant.EventMessageContext{})
+}
+
+// SetStateAsUser changes the state of an entity as if it was changed by a
+// Home Assistant user, e.g. from the app.
+func (s *Server) SetStateAsUser(userID, entityID, state string, attributes map[string]any) {
+	s.SetStateWithContext(entityID, state, attributes, homeassistant.EventMessageContext{
+		UserID: userID,
+	})
+}
+
+// SetStateWithContext changes the state of an entity with the given event
+// context, e.g. with a parent ID to simulate a Home Assistant automation. The
+// context ID is generated if it is empty.
+func (s *Server) SetStateWithContext(entityID, state string, attributes map[string]any, ctx homeassistant.EventMessageContext) {
+	if ctx.ID == "" {
+		ctx.ID = s.nextContextID()
+	}
+
+	s.lock.Lock()
+	oldState, exists := s.states[entityID]
+
+	newState := homeassistant.State{
+		EntityID:    entityID,
+		State:       state,
+		Attributes:  map[string]any{},
+		LastChanged: oldState.LastChanged,
+	}
+
+	for k, v := range oldState.Attributes {
+		newState.Attributes[k] = v
+	}
+
+	for k, v := range attributes {
+		newState.Attributes[k] = v
+	}
+	s.lock.Unlock()
+
+	var oldStatePtr *homeassistant.State
+	if exists {
+		oldStatePtr = &oldState
+	}
+
+	s.setState(newState, oldStatePtr, ctx)
+}
+
+// FireEvent simulates an event entity (e.g. a button) firing. Like Home
+// Assistant, the state of an event entity is the time it last fired. Events
+// fired at the same time on the mock clock get a later time than the last one,
+// since every firing in Home Assistant has a time of its own.
+func (s *Server) FireEvent(entityID, eventType string, attributes map[string]any) {
+	eventAttributes := map[string]any{"event_type": eventType}
+	for k, v := range attributes {
+		eventAttributes[k] = v
+	}
+
+	fired := s.now().UTC()
+
+	if state, ok := s.State(entityID); ok {
+		if last, err := time.Parse(time.RFC3339Nano, state.State); err == nil && !fired.After(last) {
+			fired = last.Add(time.Microsecond)
+		}
+	}
+
+	s.SetState(entityID, fired.Format(time.RFC3339Nano), eventAttributes)
+}
+
+func (s *Server) now() time.Time {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.clock.Now()
+}
+
+// setState stores a new state and emits a state_changed event.
+func (s *Server) setState(newState homeassistant.State, oldState *homeassistant.State, ctx homeassistant.EventMessageContext) {
+	now := s.now()
+
+	newState.LastUpdated = now
+	newState.LastReported = now
+
+	if oldState == nil || oldState.State != newState.State {
+		newState.LastChanged = now
+	}
+
+	s.lock.Lock()
+	s.states[newState.EntityID] = newState
+	s.lock.Unlock()
+
+	s.SendEvent(homeassistant.Event{
+		EventType: homeassistant.EventTypeStateChanged,
+		TimeFired: now.UTC().Format(time.RFC3339Nano),
+		Origin:    "LOCAL",
+		Context:   ctx,
+		EventData: homeassistant.EventData{
+			EntityID: newState.EntityID,
+			OldState: oldState,
+			NewState: &newState,
+		},
+	})
+}
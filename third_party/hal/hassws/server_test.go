@@ -0,0 +1,62 @@
+package hassws
+
+import (
+	"testing"
+
+	"github.com/dansimau/hal/homeassistant"
+)
+
+func TestServerOnlyEmitsEventsForChangedStates(t *testing.T) {
+	client, server := newTestClient(t, ClientConfig{})
+	defer client.Close()
+
+	if err := client.SubscribeEvents(homeassistant.EventTypeStateChanged, func(EventMessage) {}); err != nil {
+		t.Fatal(err)
+	}
+
+	server.SeedStates(homeassistant.State{
+		EntityID:   "light.test",
+		State:      "on",
+		Attributes: map[string]any{"brightness": float64(100)},
+	})
+
+	callService := func(service string, data map[string]any) {
+		t.Helper()
+
+		data["entity_id"] = "light.test"
+
+		if _, err := client.CallService(CallServiceRequest{
+			Type:    MessageTypeCallService,
+			Domain:  "light",
+			Service: service,
+			Data:    data,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The server handles messages in order, so once a ping is answered it
+	// has emitted the events for every earlier call
+	ping := func() {
+		t.Helper()
+
+		if err := client.Ping(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	callService("turn_on", map[string]any{"brightness": 100})
+	ping()
+
+	if n := server.EventsSent(); n != 0 {
+		t.Errorf("expected no events for a light that didn't change, got %d", n)
+	}
+
+	callService("turn_on", map[string]any{"brightness": 50})
+	callService("turn_off", map[string]any{})
+	ping()
+
+	if n := server.EventsSent(); n != 2 {
+		t.Errorf("expected 2 events, got %d", n)
+	}
+}
@@ -0,0 +1,221 @@
+package hal
+
+import (
+	"slices"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/dansimau/hal/logger"
+	"github.com/dansimau/hal/store"
+)
+
+// Debouncer is an interface that can be implemented by automations that want
+// state changes to settle before they are triggered. The automation is only
+// triggered once an entity hasn't changed for the duration, with its latest
+// state.
+type Debouncer interface {
+	Debounce() time.Duration
+}
+
+// StateDebouncer can be implemented alongside Debouncer to only debounce
+// changes to some states, e.g. a sensor clearing. Changes to any other state
+// trigger the automation straight away, and drop a change that was being held
+// back.
+type StateDebouncer interface {
+	DebouncedStates() []string
+}
+
+// Throttler is an interface that can be implemented by automations that want
+// to be triggered at most once per duration for each entity. Changes in
+// between are held back, and the latest one is delivered at the end of the
+// interval so the automation always sees the final state.
+type Throttler interface {
+	Throttle() time.Duration
+}
+
+// limitKey identifies the debounce and throttle state of an automation for
+// one entity.
+type limitKey struct {
+	automation int
+	entityID   string
+}
+
+type limitState struct {
+	// Latest trigger held back by the debounce or throttle.
+	debounced *Trigger
+	throttled *Trigger
+
+	debounceTimer *clock.Timer
+	throttleTimer *clock.Timer
+
+	lastDispatched time.Time
+}
+
+// limitTrigger dispatches the trigger to the automation, first applying the
+// automation's debounce and then its throttle. The lock is held until the
+// trigger is dispatched, so that a trigger released by a debounce or throttle
+// timer can't be dispatched after a newer one.
+func (h *Connection) limitTrigger(registered registeredAutomation, trigger Trigger) {
+	h.limitsMutex.Lock()
+	defer h.limitsMutex.Unlock()
+
+	automation := registered.automation
+
+	var debounce time.Duration
+	if debouncer, ok := automation.(Debouncer); ok {
+		debounce = debouncer.Debounce()
+	}
+
+	if debounce <= 0 {
+		h.throttleTrigger(registered, trigger)
+
+		return
+	}
+
+	key := limitKey{automation: registered.id, entityID: trigger.Entity.GetID()}
+	state := h.limitState(key)
+
+	if !debounces(automation, trigger) {
+		if state.debounceTimer != nil {
+			state.debounceTimer.Stop()
+		}
+
+		state.debounced = nil
+		h.throttleTrigger(registered, trigger)
+
+		return
+	}
+
+	if state.debounced != nil {
+		logger.Debug("Debouncing state change", key.entityID, "automation", automation.Name())
+		h.metricsService.RecordCounter(store.MetricTypeTriggerSuppressed, key.entityID, automation.Name())
+	}
+
+	state.debounced = &trigger
+
+	if state.debounceTimer != nil {
+		state.debounceTimer.Stop()
+	}
+
+	var timer *clock.Timer
+
+	timer = h.clock.AfterFunc(debounce, func() {
+		h.limitsMutex.Lock()
+		defer h.limitsMutex.Unlock()
+
+		// Stopped and replaced while waiting for the lock
+		if state.debounceTimer != timer {
+			return
+		}
+
+		settled := state.debounced
+		state.debounced = nil
+
+		if settled != nil && !h.closing.Load() {
+			h.throttleTrigger(registered, *settled)
+		}
+	})
+	state.debounceTimer = timer
+}
+
+// debounces returns true if the automation debounces changes to the state of
+// the trigger, see StateDebouncer.
+func debounces(automation Automation, trigger Trigger) bool {
+	debouncer, ok := automation.(StateDebouncer)
+	if !ok {
+		return true
+	}
+
+	states := debouncer.DebouncedStates()
+
+	return len(states) == 0 || slices.Contains(states, trigger.NewState.State)
+}
+
+// throttleTrigger dispatches the trigger to the automation, unless it was
+// dispatched for the entity within the throttle interval. In that case the
+// trigger is held back until the end of the interval, replacing any trigger
+// that was held back before. The caller must hold limitsMutex.
+func (h *Connection) throttleTrigger(registered registeredAutomation, trigger Trigger) {
+	automation := registered.automation
+
+	var throttle time.Duration
+	if throttler, ok := automation.(Throttler); ok {
+		throttle = throttler.Throttle()
+	}
+
+	if throttle <= 0 {
+		h.dispatchTrigger(registered, trigger)
+
+		return
+	}
+
+	key := limitKey{automation: registered.id, entityID: trigger.Entity.GetID()}
+	state := h.limitState(key)
+	now := h.clock.Now()
+
+	// Waiting for the end of the interval already
+	if state.throttled != nil {
+		logger.Debug("Throttling state change", key.entityID, "automation", automation.Name())
+		h.metricsService.RecordCounter(store.MetricTypeTriggerSuppressed, key.entityID, automation.Name())
+
+		state.throttled = &trigger
+
+		return
+	}
+
+	next := state.lastDispatched.Add(throttle)
+	if !now.Before(next) {
+		state.lastDispatched = now
+		h.dispatchTrigger(registered, trigger)
+
+		return
+	}
+
+	logger.Debug("Throttling state change", key.entityID, "automation", automation.Name(), "until", next)
+
+	state.throttled = &trigger
+	state.throttleTimer = h.clock.AfterFunc(next.Sub(now), func() {
+		h.limitsMutex.Lock()
+		defer h.limitsMutex.Unlock()
+
+		latest := state.throttled
+		state.throttled = nil
+		state.lastDispatched = h.clock.Now()
+
+		if latest != nil && !h.closing.Load() {
+			h.dispatchTrigger(registered, *latest)
+		}
+	})
+}
+
+// limitState returns the debounce and throttle state for the key, creating it
+// if needed. The caller must hold limitsMutex.
+func (h *Connection) limitState(key limitKey) *limitState {
+	state, ok := h.limits[key]
+	if !ok {
+		state = &limitState{}
+		h.limits[key] = state
+	}
+
+	return state
+}
+
+// stopLimitTimers stops pending debounce and throttle timers, dropping the
+// triggers they were holding back.
+func (h *Connection) stopLimitTimers() {
+	h.limitsMutex.Lock()
+	defer h.limitsMutex.Unlock()
+
+	for _, state := range h.limits {
+		if state.debounceTimer != nil {
+			state.debounceTimer.Stop()
+		}
+
+		if state.throttleTimer != nil {
+			state.throttleTimer.Stop()
+		}
+
+		state.debounced = nil
+		state.throttled = nil
+	}
+}
@@ -0,0 +1,85 @@
+package hal_test
+
+import (
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dansimau/hal"
+)
+
+// stateRecorder records the states an automation was triggered with.
+type stateRecorder struct {
+	mutex  sync.Mutex
+	states []string
+}
+
+func (r *stateRecorder) record(trigger hal.Trigger) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.states = append(r.states, trigger.NewState.State)
+}
+
+func (r *stateRecorder) assert(t *testing.T, expected ...string) {
+	t.Helper()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if !slices.Equal(r.states, expected) {
+		t.Errorf("expected to be triggered with %v, got %v", expected, r.states)
+	}
+}
+
+func TestDebounceOnlyHoldsBackGivenStates(t *testing.T) {
+	recorder := &stateRecorder{}
+
+	h, _ := startConnection(t, func(sensor *hal.BinarySensor) []hal.Automation {
+		return []hal.Automation{
+			hal.NewAutomation().
+				WithName("Debounced").
+				WithEntities(sensor).
+				WithDebounce(time.Second, "off").
+				WithTriggerAction(recorder.record),
+		}
+	})
+
+	h.SetState(testSensor, "on")
+	recorder.assert(t, "on")
+
+	// Clearing briefly is dropped once the sensor triggers again
+	h.SetState(testSensor, "off")
+	h.SetState(testSensor, "on")
+	h.Advance(time.Second)
+	recorder.assert(t, "on", "on")
+
+	h.SetState(testSensor, "off")
+	recorder.assert(t, "on", "on")
+
+	h.Advance(time.Second)
+	recorder.assert(t, "on", "on", "off")
+}
+
+func TestThrottleDeliversLatestChangeAtEndOfInterval(t *testing.T) {
+	recorder := &stateRecorder{}
+
+	h, _ := startConnection(t, func(sensor *hal.BinarySensor) []hal.Automation {
+		return []hal.Automation{
+			hal.NewAutomation().
+				WithName("Throttled").
+				WithEntities(sensor).
+				WithThrottle(time.Minute).
+				WithTriggerAction(recorder.record),
+		}
+	})
+
+	h.SetState(testSensor, "on")
+	h.SetState(testSensor, "off")
+	h.SetState(testSensor, "on")
+	recorder.assert(t, "on")
+
+	h.Advance(time.Minute)
+	recorder.assert(t, "on", "on")
+}
@@ -0,0 +1,118 @@
+package hal_test
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dansimau/hal"
+	"github.com/dansimau/hal/haltest"
+	"github.com/dansimau/hal/homeassistant"
+	"github.com/dansimau/hal/logger"
+	"github.com/dansimau/hal/store"
+)
+
+func TestShutdownDrainsAutomationsAndKeepsTimers(t *testing.T) {
+	var (
+		finished atomic.Bool
+		fired    atomic.Bool
+	)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	h := haltest.New(t)
+	h.Seed(homeassistant.State{EntityID: testSensor, State: "off"})
+
+	sensor := hal.NewBinarySensor(testSensor)
+	connection := h.StartConnection(&struct{ Sensor *hal.BinarySensor }{sensor},
+		hal.NewAutomation().
+			WithName("Slow").
+			WithEntities(sensor).
+			WithAction(func(_ hal.EntityInterface) {
+				close(started)
+				<-release
+
+				logger.Info("Slow automation finished", "")
+				finished.Store(true)
+			}),
+	)
+
+	timer := connection.NewTimer("shutdown-test")
+	timer.Start(func() { fired.Store(true) }, time.Hour)
+
+	h.Server.SetState(testSensor, "on", nil)
+	<-started
+
+	shutdown := make(chan error, 1)
+
+	go func() {
+		shutdown <- connection.Shutdown(context.Background())
+	}()
+
+	select {
+	case err := <-shutdown:
+		t.Fatalf("expected shutdown to wait for the running automation, returned %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+
+	if err := <-shutdown; err != nil {
+		t.Fatalf("failed to shut down: %v", err)
+	}
+
+	if !finished.Load() {
+		t.Error("expected the running automation to finish before shutdown returned")
+	}
+
+	// A second close does nothing
+	connection.Close()
+
+	if fired.Load() {
+		t.Error("expected the timer not to fire on shutdown")
+	}
+
+	db, err := store.Open(h.Config().DatabasePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+
+	var timers []store.Timer
+	if err := db.Find(&timers).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if len(timers) != 1 || timers[0].Name != "shutdown-test" || !timers[0].Deadline.Equal(haltest.StartTime.Add(time.Hour)) {
+		t.Errorf("expected the running timer to stay persisted, got %+v", timers)
+	}
+
+	// Everything logged and recorded before the database was closed was
+	// written
+	var logs int64
+	if err := db.Model(&store.Log{}).Where("log_text = ?", "Slow automation finished").Count(&logs).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if logs != 1 {
+		t.Errorf("expected the log line of the drained automation to be written, got %d", logs)
+	}
+
+	var triggered int64
+	if err := db.Model(&store.Metric{}).
+		Where("metric_type = ? AND automation_name = ?", store.MetricTypeAutomationTriggered, "Slow").
+		Count(&triggered).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if triggered != 1 {
+		t.Errorf("expected the trigger to be recorded, got %d", triggered)
+	}
+}
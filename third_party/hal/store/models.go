@@ -0,0 +1,94 @@
+package store
+
+import (
+	"time"
+
+	"github.com/dansimau/hal/homeassistant"
+)
+
+type Model struct {
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+type Entity struct {
+	Model
+
+	ID    string `gorm:"primaryKey"`
+	Type  string
+	State *homeassistant.State `gorm:"serializer:json"`
+}
+
+// Timer is a running timer that is persisted so it can be restored after a
+// restart.
+type Timer struct {
+	Model
+
+	Name       string `gorm:"primaryKey"`
+	Automation string
+	Deadline   time.Time
+}
+
+// HealthStatus is the health of a sensor, as recorded by the health monitor.
+type HealthStatus string
+
+const (
+	HealthStatusOK          HealthStatus = "ok"
+	HealthStatusLowBattery  HealthStatus = "low_battery"
+	HealthStatusStale       HealthStatus = "stale"
+	HealthStatusUnavailable HealthStatus = "unavailable"
+)
+
+// EntityHealth is the last known health of a sensor, kept up to date by the
+// health monitor.
+type EntityHealth struct {
+	Model
+
+	EntityID string `gorm:"primaryKey"`
+	Status   HealthStatus
+	Detail   string
+
+	// Companion battery sensor, if one was found.
+	BatteryEntityID string
+	BatteryLevel    *float64
+
+	// LastUpdated is when Home Assistant last heard from the sensor.
+	LastUpdated time.Time
+
+	// StatusSince is when the sensor entered its current status.
+	StatusSince time.Time
+	CheckedAt   time.Time
+}
+
+// MetricType represents the type of metric being recorded
+type MetricType string
+
+// MetricType constants
+const (
+	MetricTypeAutomationPanic      MetricType = "automation_panic"
+	MetricTypeAutomationQueueDepth MetricType = "automation_queue_depth"
+	MetricTypeAutomationQueueWait  MetricType = "automation_queue_wait"
+	MetricTypeAutomationTriggered  MetricType = "automation_triggered"
+	MetricTypeConnectionOutage     MetricType = "connection_outage"
+	MetricTypeEntityFlapping       MetricType = "entity_flapping"
+	MetricTypeTickProcessingTime   MetricType = "tick_processing_time"
+	MetricTypeTriggerSuppressed    MetricType = "trigger_suppressed"
+)
+
+// Metric represents a single metric data point
+type Metric struct {
+	ID             uint       `gorm:"primaryKey;autoIncrement"`
+	Timestamp      time.Time  `gorm:"index;not null"`
+	MetricType     MetricType `gorm:"not null;size:50"`
+	Value          int64      `gorm:"not null"` // For counters: 1, for timers: nanoseconds
+	EntityID       string     `gorm:"size:100"` // Optional: which entity triggered this
+	AutomationName string     `gorm:"size:100"` // Optional: which automation was involved
+}
+
+// Log represents a single log entry
+type Log struct {
+	ID        uint      `gorm:"primaryKey;autoIncrement"`
+	Timestamp time.Time `gorm:"index;not null"`
+	EntityID  string    `gorm:"index;size:255"` // Optional: which entity this log relates to
+	LogText   string    `gorm:"not null;type:text"`
+}
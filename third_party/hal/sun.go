@@ -0,0 +1,64 @@
+package hal
+
+import (
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/dansimau/hal/logger"
+	"github.com/nathan-osman/go-sunrise"
+)
+
+type SunTimes struct {
+	clock    clock.Clock
+	location LocationConfig
+}
+
+// NewSunTimes returns sun times for the location. If clk is nil the real clock
+// is used.
+func NewSunTimes(cfg LocationConfig, clk clock.Clock) *SunTimes {
+	if clk == nil {
+		clk = clock.New()
+	}
+
+	sunTimes := &SunTimes{
+		clock:    clk,
+		location: cfg,
+	}
+
+	logger.Info("Sun times for location", "",
+		"lat", cfg.Latitude,
+		"lng", cfg.Longitude,
+		"sunrise", sunTimes.Sunrise().Local().Format(time.Kitchen),
+		"sunset", sunTimes.Sunset().Local().Format(time.Kitchen),
+	)
+
+	return sunTimes
+}
+
+func (s *SunTimes) IsDayTime() bool {
+	now := s.clock.Now()
+
+	rise, set := sunrise.SunriseSunset(s.location.Latitude, s.location.Longitude, now.Year(), now.Month(), now.Day())
+
+	return now.After(rise) && now.Before(set)
+}
+
+func (s *SunTimes) IsNightTime() bool {
+	return !s.IsDayTime()
+}
+
+func (s *SunTimes) Sunrise() time.Time {
+	now := s.clock.Now()
+
+	rise, _ := sunrise.SunriseSunset(s.location.Latitude, s.location.Longitude, now.Year(), now.Month(), now.Day())
+
+	return rise
+}
+
+func (s *SunTimes) Sunset() time.Time {
+	now := s.clock.Now()
+
+	_, set := sunrise.SunriseSunset(s.location.Latitude, s.location.Longitude, now.Year(), now.Month(), now.Day())
+
+	return set
+}
@@ -0,0 +1,360 @@
+package hal
+
+import (
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/dansimau/hal/logger"
+	"github.com/dansimau/hal/store"
+	"gorm.io/gorm/clause"
+)
+
+// Timers shorter than this are not persisted. They are over soon after a
+// restart anyway, and automations reconcile them, so they aren't worth a
+// database write on every start.
+const minPersistedDuration = time.Minute
+
+// Restarting a timer that moves its deadline by less than this doesn't update
+// the saved deadline, so that timers restarted on every state change don't
+// write to the database each time. After a restart, such a timer may fire up
+// to this much early or late.
+const persistPrecision = 10 * time.Second
+
+// Timer wraps time.Timer to add functionality for checking if the timer is running.
+//
+// Named timers that are bound to a connection are persisted: their deadline is
+// saved to the database and restored when the connection starts, so they
+// survive restarts. Timers started for less than a minute are not persisted.
+//
+// Timers bound to a connection fire on the same queues as state changes:
+// timers owned by an automation fire on the automation's queue, so the action
+// never runs concurrently with the automation handling a state change. Each
+// firing is logged and counted as a trigger of the automation, with a
+// synthetic entity ID of "timer.<name>". Timers that are not bound to a
+// connection fire on a goroutine of their own, and a panic in their action is
+// recovered and logged.
+type Timer struct {
+	action     func()
+	automation string
+	clock      clock.Clock
+	connection *Connection
+	name       string
+	owner      registeredAutomation
+	timer      *clock.Timer
+	running    bool
+
+	// Whether the deadline is saved in the database, and the deadline saved.
+	persisted         bool
+	persistedDeadline time.Time
+
+	// Incremented every time the timer is started or cancelled, so that a
+	// firing that was queued before then can be discarded.
+	generation uint64
+
+	// Guards the state of the timer, which is changed both by its owner and
+	// when it fires.
+	mutex sync.Mutex
+}
+
+// TimerOwner is an interface that can be implemented by automations that own
+// timers. The timers are bound to the connection when the automation is
+// registered.
+type TimerOwner interface {
+	Timers() []*Timer
+}
+
+// NewTimer returns a timer using the clock. Timers started for less than
+// minPersistedDuration (a minute) are never persisted, so they aren't
+// restored after a restart, even if they are named.
+func NewTimer(clock clock.Clock) *Timer {
+	return &Timer{
+		clock: clock,
+	}
+}
+
+// WithName sets the name under which the timer is persisted. Unnamed timers
+// are not persisted.
+func (t *Timer) WithName(name string) *Timer {
+	t.name = name
+
+	return t
+}
+
+// WithClock sets the clock of the timer, e.g. a mock clock for testing.
+// Otherwise the timer uses the clock of the connection it is bound to.
+func (t *Timer) WithClock(clock clock.Clock) *Timer {
+	t.clock = clock
+
+	return t
+}
+
+// WithAction sets the function that is called when the timer fires. Actions
+// should be set up front for persisted timers, so that they can be restored.
+func (t *Timer) WithAction(fn func()) *Timer {
+	t.action = fn
+
+	return t
+}
+
+// BindConnection binds the timer to a connection. If the timer has no clock,
+// it uses the connection's clock.
+func (t *Timer) BindConnection(connection *Connection) {
+	t.connection = connection
+
+	// Timers that don't belong to an automation get a queue of their own
+	if t.owner.automation == nil {
+		t.owner = connection.newRegisteredAutomation(&timerAutomation{timer: t})
+	}
+
+	if t.clock == nil {
+		t.clock = connection.clock
+	}
+}
+
+func (t *Timer) Cancel() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.cancel()
+}
+
+func (t *Timer) cancel() {
+	if t.timer == nil && !t.running {
+		return
+	}
+
+	t.generation++
+
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+
+	t.running = false
+	t.unpersist()
+}
+
+// Start starts the timer or resets it to a new duration. If fn is nil, the
+// action set with WithAction (if any) is called when the timer fires.
+func (t *Timer) Start(fn func(), duration time.Duration) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.start(fn, duration)
+}
+
+func (t *Timer) start(fn func(), duration time.Duration) {
+	if t.clock == nil {
+		t.clock = clock.New()
+	}
+
+	if fn != nil {
+		t.action = fn
+	}
+
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+
+	t.generation++
+	generation := t.generation
+
+	t.timer = t.clock.AfterFunc(duration, func() {
+		t.fire(generation)
+	})
+
+	t.running = true
+
+	if duration < minPersistedDuration {
+		t.unpersist()
+
+		return
+	}
+
+	t.persist(t.clock.Now().Add(duration))
+}
+
+// StartUntil starts the timer so that it fires at the deadline. If the
+// deadline has already passed, the timer fires immediately.
+func (t *Timer) StartUntil(fn func(), deadline time.Time) {
+	t.mutex.Lock()
+
+	if t.clock == nil {
+		t.clock = clock.New()
+	}
+
+	remaining := deadline.Sub(t.clock.Now())
+	if remaining > 0 {
+		t.start(fn, remaining)
+		t.mutex.Unlock()
+
+		return
+	}
+
+	if fn != nil {
+		t.action = fn
+	}
+
+	t.cancel()
+	generation := t.generation
+	t.mutex.Unlock()
+
+	t.fire(generation)
+}
+
+// IsRunning returns whether the timer is currently running.
+func (t *Timer) IsRunning() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.running
+}
+
+// fire runs the action of the timer. For timers owned by an automation, it is
+// queued to run on the automation's queue.
+func (t *Timer) fire(generation uint64) {
+	run := func() {
+		t.mutex.Lock()
+
+		// Timer was restarted or cancelled after it fired
+		if generation != t.generation {
+			t.mutex.Unlock()
+			logger.Debug("Discarding stale timer firing", "", "timer", t.name, "automation", t.automation)
+
+			return
+		}
+
+		t.running = false
+		t.unpersist()
+		action := t.action
+		t.mutex.Unlock()
+
+		// The action may well restart the timer
+		if action != nil {
+			action()
+		}
+	}
+
+	// Without a connection there is no automation queue to run on, and no
+	// circuit breaker to recover a panic
+	if t.connection == nil {
+		defer func() {
+			if r := recover(); r != nil {
+				logger.Error("Timer action panicked", "", "timer", t.name, "panic", r, "stack", string(debug.Stack()))
+			}
+		}()
+
+		run()
+
+		return
+	}
+
+	// Leave the timer persisted so it's restored on the next start
+	if t.connection.closing.Load() {
+		return
+	}
+
+	triggerID := t.triggerID()
+	automationName := t.owner.automation.Name()
+
+	logger.Info("Timer fired, running automation", triggerID, "name", automationName)
+	t.connection.metricsService.RecordCounter(store.MetricTypeAutomationTriggered, triggerID, automationName)
+	t.connection.dispatch(t.owner, triggerID, run)
+}
+
+// triggerID is the synthetic entity ID used for the timer in logs and metrics.
+func (t *Timer) triggerID() string {
+	if t.name != "" {
+		return "timer." + t.name
+	}
+
+	return "timer." + t.automation
+}
+
+// timerAutomation stands in for the owner of a timer that doesn't belong to
+// an automation, so that it can be dispatched like one.
+type timerAutomation struct {
+	timer *Timer
+}
+
+func (a *timerAutomation) Name() string {
+	return a.timer.name
+}
+
+func (a *timerAutomation) Entities() Entities {
+	return nil
+}
+
+func (a *timerAutomation) Action(_ EntityInterface) {}
+
+// restore restarts a persisted timer so that it fires at its original
+// deadline. If the deadline passed while hal was down, the timer is left
+// running without firing and a function that fires it is returned, so that
+// its automation can reconcile first. The firing is discarded if reconciling
+// cancelled or restarted the timer.
+func (t *Timer) restore(deadline time.Time) (fireOverdue func()) {
+	remaining := deadline.Sub(t.clock.Now())
+
+	logger.Info("Restoring timer", "", "timer", t.name, "automation", t.automation, "remaining", remaining.String())
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.persisted = true
+	t.persistedDeadline = deadline
+
+	if remaining > 0 {
+		t.start(nil, remaining)
+
+		return nil
+	}
+
+	t.generation++
+	t.running = true
+	generation := t.generation
+
+	return func() {
+		t.fire(generation)
+	}
+}
+
+func (t *Timer) persist(deadline time.Time) {
+	if t.connection == nil || t.name == "" {
+		return
+	}
+
+	if t.persisted && deadline.Sub(t.persistedDeadline).Abs() < persistPrecision {
+		return
+	}
+
+	if err := t.connection.db.Clauses(clause.OnConflict{
+		UpdateAll: true,
+	}).Create(&store.Timer{
+		Name:       t.name,
+		Automation: t.automation,
+		Deadline:   deadline,
+	}).Error; err != nil {
+		logger.Error("Failed to persist timer", "", "timer", t.name, "error", err)
+
+		return
+	}
+
+	t.persisted = true
+	t.persistedDeadline = deadline
+}
+
+// unpersist deletes the saved deadline, if there is one.
+func (t *Timer) unpersist() {
+	if !t.persisted {
+		return
+	}
+
+	if err := t.connection.db.Delete(&store.Timer{Name: t.name}).Error; err != nil {
+		logger.Error("Failed to delete persisted timer", "", "timer", t.name, "error", err)
+
+		return
+	}
+
+	t.persisted = false
+}
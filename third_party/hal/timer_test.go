@@ -0,0 +1,159 @@
+package hal_test
+
+import (
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/dansimau/hal"
+	"github.com/dansimau/hal/store"
+)
+
+// timerAutomation is an automation that owns a timer.
+type timerAutomation struct {
+	entities hal.Entities
+	timer    *hal.Timer
+}
+
+func (a timerAutomation) Name() string                 { return "Timed" }
+func (a timerAutomation) Entities() hal.Entities       { return a.entities }
+func (a timerAutomation) Action(_ hal.EntityInterface) {}
+func (a timerAutomation) Timers() []*hal.Timer         { return []*hal.Timer{a.timer} }
+
+func TestUnboundTimerRecoversPanickingAction(t *testing.T) {
+	mockClock := clock.NewMock()
+	timer := hal.NewTimer(mockClock)
+
+	panicked := make(chan struct{})
+
+	timer.Start(func() {
+		close(panicked)
+		panic("boom")
+	}, time.Second)
+	mockClock.Add(time.Second)
+
+	select {
+	case <-panicked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the timer to fire")
+	}
+
+	fired := make(chan struct{})
+
+	timer.Start(func() { close(fired) }, time.Second)
+
+	if !timer.IsRunning() {
+		t.Error("expected the timer to be running after a restart")
+	}
+
+	mockClock.Add(time.Second)
+
+	select {
+	case <-fired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the restarted timer to fire")
+	}
+}
+
+func TestUnboundTimerCanBeRestartedFromItsAction(t *testing.T) {
+	mockClock := clock.NewMock()
+	timer := hal.NewTimer(mockClock)
+
+	fired := make(chan struct{}, 2)
+
+	timer.Start(func() {
+		timer.Start(nil, time.Second)
+		fired <- struct{}{}
+	}, time.Second)
+
+	for range 2 {
+		mockClock.Add(time.Second)
+
+		select {
+		case <-fired:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the timer to fire")
+		}
+	}
+
+	timer.Cancel()
+
+	if timer.IsRunning() {
+		t.Error("expected the timer to be stopped after cancelling")
+	}
+}
+
+func TestTimerFiresAsTriggerOfItsAutomation(t *testing.T) {
+	timer := hal.NewTimer(nil).WithName("porch")
+
+	h, connection := startConnection(t, func(sensor *hal.BinarySensor) []hal.Automation {
+		return []hal.Automation{timerAutomation{entities: hal.Entities{sensor}, timer: timer}}
+	})
+
+	var fired atomic.Bool
+
+	timer.Start(func() { fired.Store(true) }, 2*time.Minute)
+	h.Advance(2 * time.Minute)
+
+	if !fired.Load() {
+		t.Fatal("expected the timer to fire")
+	}
+
+	var logs []store.Log
+	if err := connection.DB().Where("entity_id = ?", "timer.porch").Find(&logs).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.ContainsFunc(logs, func(log store.Log) bool {
+		return strings.HasPrefix(log.LogText, "Timer fired, running automation") && strings.Contains(log.LogText, "name=Timed")
+	}) {
+		t.Errorf("expected the firing to be logged for timer.porch, got %+v", logs)
+	}
+
+	var metrics []store.Metric
+	if err := connection.DB().Where("metric_type = ?", store.MetricTypeAutomationTriggered).Find(&metrics).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if len(metrics) != 1 || metrics[0].EntityID != "timer.porch" || metrics[0].AutomationName != "Timed" {
+		t.Errorf("expected a trigger of Timed by timer.porch to be recorded, got %+v", metrics)
+	}
+}
+
+func TestTimerOnlyPersistsDeadlineWhenItMoves(t *testing.T) {
+	h, connection := startConnection(t, func(_ *hal.BinarySensor) []hal.Automation { return nil })
+
+	timer := connection.NewTimer("porch")
+
+	persisted := func() time.Time {
+		t.Helper()
+
+		var row store.Timer
+		if err := connection.DB().First(&row, "name = ?", "porch").Error; err != nil {
+			t.Fatalf("timer not persisted: %v", err)
+		}
+
+		return row.Deadline
+	}
+
+	timer.Start(func() {}, 10*time.Minute)
+	deadline := h.Clock.Now().Add(10 * time.Minute)
+
+	// Restarting a few seconds later keeps the saved deadline
+	h.Advance(2 * time.Second)
+	timer.Start(nil, 10*time.Minute)
+
+	if saved := persisted(); !saved.Equal(deadline) {
+		t.Errorf("expected the saved deadline to stay at %s, got %s", deadline, saved)
+	}
+
+	h.Advance(time.Minute)
+	timer.Start(nil, 10*time.Minute)
+
+	if saved, expected := persisted(), h.Clock.Now().Add(10*time.Minute); !saved.Equal(expected) {
+		t.Errorf("expected the saved deadline to move to %s, got %s", expected, saved)
+	}
+}
@@ -0,0 +1,248 @@
+package hal
+
+import (
+	"reflect"
+	"slices"
+
+	"github.com/dansimau/hal/homeassistant"
+	"github.com/dansimau/hal/logger"
+)
+
+// Trigger is a state change that triggered an automation.
+type Trigger struct {
+	// Entity is the entity that changed. For light groups this is the member
+	// that changed.
+	Entity EntityInterface
+
+	// OldState is the state before the change. It is empty if the entity
+	// didn't exist before, or if the trigger is a restored "for" hold.
+	OldState homeassistant.State
+
+	NewState homeassistant.State
+
+	// Change is what caused the state change.
+	Change StateChange
+}
+
+// StateChanged returns true if the state itself changed, as opposed to only
+// its attributes.
+func (t Trigger) StateChanged() bool {
+	return t.OldState.State != t.NewState.State
+}
+
+// AttributeChanged returns true if the attribute has a different value after
+// the change.
+func (t Trigger) AttributeChanged(attribute string) bool {
+	return !reflect.DeepEqual(t.OldState.Attributes[attribute], t.NewState.Attributes[attribute])
+}
+
+// TriggerHandler is an interface that can be implemented by automations that
+// need the states before and after the change that triggered them. If it is
+// implemented, HandleTrigger is called instead of Action.
+type TriggerHandler interface {
+	HandleTrigger(trigger Trigger)
+}
+
+// matches returns true if the trigger passes all of the automation's trigger
+// filters.
+func (c *AutomationConfig) matches(trigger Trigger) bool {
+	if len(c.fromStates) > 0 && !slices.Contains(c.fromStates, trigger.OldState.State) {
+		return false
+	}
+
+	if len(c.toStates) > 0 && !slices.Contains(c.toStates, trigger.NewState.State) {
+		return false
+	}
+
+	if c.ignoreAttributeOnly && !trigger.StateChanged() {
+		return false
+	}
+
+	if len(c.attributes) > 0 && !slices.ContainsFunc(c.attributes, trigger.AttributeChanged) {
+		return false
+	}
+
+	return true
+}
+
+// holdBroken returns true if the change ends a "for" hold: the entity left
+// the "to" states or, without "to" states, changed state at all.
+func (c *AutomationConfig) holdBroken(trigger Trigger) bool {
+	if len(c.toStates) > 0 {
+		return !slices.Contains(c.toStates, trigger.NewState.State)
+	}
+
+	return trigger.StateChanged()
+}
+
+// HandleTrigger runs the action if the state change passes the automation's
+// trigger filters. With a "for" duration, the action runs once the entity has
+// held the state for that long.
+func (c *AutomationConfig) HandleTrigger(trigger Trigger) {
+	entityID := trigger.Entity.GetID()
+
+	if c.holdWhenUnavailable && !isAvailableState(trigger.NewState.State) {
+		logger.Info("Entity unavailable, holding last known state", entityID, "automation", c.name, "state", trigger.NewState.State)
+
+		return
+	}
+
+	if !c.matches(trigger) {
+		if hold, ok := c.holdTimers[entityID]; ok && hold.IsRunning() && c.holdBroken(trigger) {
+			logger.Info("State no longer held, cancelling", entityID, "automation", c.name, "state", trigger.NewState.State)
+			hold.Cancel()
+			delete(c.pendingHolds, entityID)
+		}
+
+		logger.Debug("State change does not match trigger", entityID, "automation", c.name)
+
+		return
+	}
+
+	hold, ok := c.holdTimers[entityID]
+	if ok && hold.IsRunning() {
+		// Already holding, e.g. an attribute changed while the state was held
+		if !c.holdBroken(trigger) {
+			return
+		}
+
+		// Without "to" states, any new state is held from scratch
+		logger.Info("State changed, restarting hold", entityID, "automation", c.name, "state", trigger.NewState.State)
+		hold.Cancel()
+		delete(c.pendingHolds, entityID)
+	}
+
+	if c.condition != nil && !c.condition() {
+		logger.Debug("Condition not met, skipping", entityID, "automation", c.name)
+
+		return
+	}
+
+	if !ok {
+		c.run(trigger)
+
+		return
+	}
+
+	logger.Info("Waiting for state to be held", entityID, "automation", c.name, "state", trigger.NewState.State, "for", c.holdFor.String())
+
+	c.pendingHolds[entityID] = trigger
+	hold.Start(nil, c.holdFor)
+}
+
+// reconcileHolds starts "for" holds for entities that are in one of the "to"
+// states, counting from when the entity changed to it. Holds are only
+// reconciled if "to" states are set, since otherwise it is not known which
+// state was being held.
+func (c *AutomationConfig) reconcileHolds() {
+	if len(c.toStates) == 0 {
+		return
+	}
+
+	for entityID, hold := range c.holdTimers {
+		state := c.holdEntities[entityID].GetState()
+
+		if c.holdWhenUnavailable && !isAvailableState(state.State) {
+			continue
+		}
+
+		if !slices.Contains(c.toStates, state.State) || (c.condition != nil && !c.condition()) {
+			hold.Cancel()
+			delete(c.pendingHolds, entityID)
+
+			continue
+		}
+
+		// Timer was restored from before a restart
+		if hold.IsRunning() || state.LastChanged.IsZero() {
+			continue
+		}
+
+		hold.StartUntil(nil, state.LastChanged.Add(c.holdFor))
+	}
+}
+
+// holdElapsed runs the action for an entity that has held its state for the
+// "for" duration. Holds that were restored after a restart have no pending
+// trigger, so the current state is used.
+func (c *AutomationConfig) holdElapsed(entity EntityInterface) {
+	entityID := entity.GetID()
+
+	trigger, ok := c.pendingHolds[entityID]
+	if !ok {
+		trigger = Trigger{
+			Entity:   entity,
+			NewState: entity.GetState(),
+			Change:   LastChange(entity),
+		}
+	}
+
+	delete(c.pendingHolds, entityID)
+
+	logger.Info("State held, running action", entityID, "automation", c.name, "for", c.holdFor.String())
+
+	c.run(trigger)
+}
+
+// holdTimersFor returns a "for" hold timer for each entity the automation
+// listens on, creating them the first time. Timers of named automations are
+// persisted.
+func (c *AutomationConfig) holdTimersFor() []*Timer {
+	if c.holdFor <= 0 {
+		return nil
+	}
+
+	if c.holdTimers != nil {
+		return c.holdTimerList
+	}
+
+	c.holdTimers = map[string]*Timer{}
+	c.holdEntities = map[string]EntityInterface{}
+	c.pendingHolds = map[string]Trigger{}
+
+	timers := []*Timer{}
+
+	for _, entity := range c.entities {
+		for _, member := range triggerEntities(entity) {
+			entityID := member.GetID()
+			if _, exists := c.holdTimers[entityID]; exists {
+				continue
+			}
+
+			timer := NewTimer(nil).WithAction(func() {
+				c.holdElapsed(member)
+			})
+
+			if c.name != "" {
+				timer.WithName(c.name + ": " + entityID + " held")
+			}
+
+			c.holdTimers[entityID] = timer
+			c.holdEntities[entityID] = member
+			timers = append(timers, timer)
+		}
+	}
+
+	c.holdTimerList = timers
+
+	return timers
+}
+
+// triggerEntities returns the entities whose state changes trigger an
+// automation for the entity: the members of a light group, or the entity
+// itself.
+func triggerEntities(entity EntityInterface) []EntityInterface {
+	group, ok := entity.(LightGroup)
+	if !ok {
+		return []EntityInterface{entity}
+	}
+
+	members := group.Members()
+
+	entities := make([]EntityInterface, len(members))
+	for i, member := range members {
+		entities[i] = member
+	}
+
+	return entities
+}
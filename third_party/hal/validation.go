@@ -0,0 +1,86 @@
+package hal
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/dansimau/hal/homeassistant"
+	"github.com/dansimau/hal/logger"
+)
+
+var (
+	ErrAutomationWithoutEntities = errors.New("automation has no entities")
+	ErrEntityDomainMismatch      = errors.New("entity domain does not match its type")
+	ErrUnknownEntity             = errors.New("entity not known to Home Assistant")
+)
+
+// DomainEntity is an interface that can be implemented by entities that only
+// make sense for certain Home Assistant domains (e.g. "light"), so that
+// entities wrapped in the wrong type can be reported at startup.
+type DomainEntity interface {
+	Domains() []string
+}
+
+// validate checks the registered entities and automations against the states
+// reported by Home Assistant. It returns one error per problem found.
+func (h *Connection) validate(states []homeassistant.State) []error {
+	known := make(map[string]bool, len(states))
+	for _, state := range states {
+		known[state.EntityID] = true
+	}
+
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	entityIDs := make([]string, 0, len(h.entities))
+	for entityID := range h.entities {
+		entityIDs = append(entityIDs, entityID)
+	}
+
+	sort.Strings(entityIDs)
+
+	var errs []error
+
+	for _, entityID := range entityIDs {
+		entity := h.entities[entityID]
+		path := describeEntityPath(h.entityPaths[entityID])
+
+		if !known[entityID] {
+			errs = append(errs, fmt.Errorf("%w: %s at %s", ErrUnknownEntity, entityID, path))
+		}
+
+		domainEntity, ok := entity.(DomainEntity)
+		if !ok {
+			continue
+		}
+
+		domain, _, _ := strings.Cut(entityID, ".")
+		if !slices.Contains(domainEntity.Domains(), domain) {
+			errs = append(errs, fmt.Errorf("%w: %s at %s is a %T, which expects domain %s",
+				ErrEntityDomainMismatch, entityID, path, entity, strings.Join(domainEntity.Domains(), " or ")))
+		}
+	}
+
+	for _, registered := range h.registered {
+		if len(registered.automation.Entities()) == 0 && !ownsTimers(registered.automation) {
+			errs = append(errs, fmt.Errorf("%w: %s", ErrAutomationWithoutEntities, registered.automation.Name()))
+		}
+	}
+
+	for _, err := range errs {
+		logger.Warn("Configuration problem", "", "error", err)
+	}
+
+	return errs
+}
+
+// ownsTimers returns true if the automation has timers of its own, so that it
+// can run without being triggered by entities, e.g. to poll states.
+func ownsTimers(automation Automation) bool {
+	owner, ok := automation.(TimerOwner)
+
+	return ok && len(owner.Timers()) > 0
+}
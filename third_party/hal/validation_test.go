@@ -0,0 +1,107 @@
+package hal_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/dansimau/hal"
+	"github.com/dansimau/hal/haltest"
+	"github.com/dansimau/hal/homeassistant"
+)
+
+// tryStartConnection starts a connection like Harness.StartConnection, but
+// returns the error from Start instead of failing the test.
+func tryStartConnection(t *testing.T, config hal.Config, entities any, automations ...hal.Automation) error {
+	t.Helper()
+
+	connection := hal.NewConnection(config)
+	connection.FindEntities(entities)
+	connection.RegisterAutomations(automations...)
+	t.Cleanup(connection.Close)
+
+	return connection.Start()
+}
+
+func TestValidation(t *testing.T) {
+	const known = "light.known"
+
+	tests := []struct {
+		name  string
+		setup func() (entities any, automations []hal.Automation)
+		err   error
+	}{
+		{
+			name: "valid",
+			setup: func() (any, []hal.Automation) {
+				light := hal.NewLight(known)
+
+				return &struct{ Light *hal.Light }{light}, []hal.Automation{
+					hal.NewAutomation().WithName("Light").WithEntities(light),
+				}
+			},
+		},
+		{
+			name: "unknown entity",
+			setup: func() (any, []hal.Automation) {
+				return &struct{ Light *hal.Light }{hal.NewLight("light.missing")}, nil
+			},
+			err: hal.ErrUnknownEntity,
+		},
+		{
+			name: "domain mismatch",
+			setup: func() (any, []hal.Automation) {
+				return &struct{ Kettle *hal.Light }{hal.NewLight("switch.kettle")}, nil
+			},
+			err: hal.ErrEntityDomainMismatch,
+		},
+		{
+			name: "automation without entities",
+			setup: func() (any, []hal.Automation) {
+				return &struct{ Light *hal.Light }{hal.NewLight(known)}, []hal.Automation{
+					hal.NewAutomation().WithName("Empty"),
+				}
+			},
+			err: hal.ErrAutomationWithoutEntities,
+		},
+		{
+			name: "automation with only timers",
+			setup: func() (any, []hal.Automation) {
+				return &struct{ Light *hal.Light }{hal.NewLight(known)}, []hal.Automation{
+					hal.NewAutomation().WithName("Polls").WithTimers(hal.NewTimer(nil)),
+				}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		for _, strict := range []bool{true, false} {
+			name := test.name + "/lenient"
+			if strict {
+				name = test.name + "/strict"
+			}
+
+			t.Run(name, func(t *testing.T) {
+				h := haltest.New(t)
+				h.Seed(
+					homeassistant.State{EntityID: known, State: "off"},
+					homeassistant.State{EntityID: "switch.kettle", State: "off"},
+				)
+
+				config := h.Config()
+				config.StrictValidation = strict
+
+				entities, automations := test.setup()
+				err := tryStartConnection(t, config, entities, automations...)
+
+				switch {
+				case strict && test.err != nil:
+					if !errors.Is(err, test.err) {
+						t.Errorf("expected %v, got %v", test.err, err)
+					}
+				case err != nil:
+					t.Errorf("expected problems to only be logged, got %v", err)
+				}
+			})
+		}
+	}
+}